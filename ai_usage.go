@@ -0,0 +1,339 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// scopes the application instance counts are totaled for
+const (
+	foundationScope = "foundation"
+	orgScope        = "org"
+	spaceScope      = "space"
+)
+
+// AIUsage daily application instance statistics
+type AIUsage struct {
+	Days []FlattenAIUsage `json:"ai_usages" csv:"ai_usages"`
+}
+
+// FlattenAIUsage running application instances of a foundation, org or space for one day
+type FlattenAIUsage struct {
+	Date             string  `json:"date" csv:"date" xlsx:"date"`
+	Scope            string  `json:"scope" csv:"scope"`
+	OrganizationGUID string  `json:"organization_guid" csv:"organization_guid"`
+	OrgName          string  `json:"organization_name" csv:"organization_name"`
+	SpaceGUID        string  `json:"space_guid" csv:"space_guid"`
+	SpaceName        string  `json:"space_name" csv:"space_name"`
+	PeakInstances    int     `json:"peak_instances" csv:"peak_instances"`
+	AverageInstances float64 `json:"average_instances" csv:"average_instances"`
+	P95Instances     int     `json:"p95_instances" csv:"p95_instances"`
+}
+
+// instanceChange running instance count of an app from a point in time
+type instanceChange struct {
+	at        time.Time
+	instances int
+}
+
+// appInstanceTimeline running instances of one app over time, rebuilt from
+//  its usage events
+type appInstanceTimeline struct {
+	orgGUID   string
+	spaceGUID string
+	spaceName string
+	initial   int
+	changes   []instanceChange
+}
+
+// instancesAt running instances of the app at the given time
+func (t *appInstanceTimeline) instancesAt(at time.Time) int {
+	instances := t.initial
+	for _, change := range t.changes {
+		if change.at.After(at) {
+			break
+		}
+		instances = change.instances
+	}
+	return instances
+}
+
+// instanceDelta change to the running instances of a scope
+type instanceDelta struct {
+	at    time.Time
+	delta int
+}
+
+// scopeInstances running instances of a foundation, org or space
+type scopeInstances struct {
+	row     FlattenAIUsage
+	initial int
+	deltas  []instanceDelta
+}
+
+// handles report formatting if CSV, NDJSON or XLSX is specified
+func aiReportFormatter(c echo.Context, usageReport *AIUsage) error {
+	var format = reportFormat(c)
+	if format == focusFormat {
+		return echo.NewHTTPError(http.StatusBadRequest, "format=focus isn't available for application instance usage")
+	}
+	if format == "xlsx" {
+		return xlsxFormatter(c, nil, aiUsageSheets(usageReport)...)
+	}
+	if format == "csv" || format == "ndjson" {
+		return newRowStream(c, format, FlattenAIUsage{}).WriteAll(usageReport.Days, nil)
+	} else {
+		return jsonFormatter(c, usageReport)
+	}
+}
+
+// aiUsageReport generates the application instance report for the range and formats it
+//  /ai-usage?start=2017-11-01&end=2017-11-03, /ai-usage/yesterday
+func aiUsageReport(c echo.Context, start time.Time, end time.Time) error {
+	usageReport, err := GenAIUsageReport(CfClient(), start, end)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't get application instance usage report")
+	}
+
+	// callers limited to some orgs see neither the other orgs nor the foundation
+	if caller := GetCaller(c); !caller.SeesAll() {
+		var days []FlattenAIUsage
+		for _, row := range usageReport.Days {
+			if row.Scope != foundationScope && caller.CanSee(row.OrganizationGUID) {
+				days = append(days, row)
+			}
+		}
+		usageReport.Days = days
+	}
+	return aiReportFormatter(c, usageReport)
+}
+
+// GenAIUsageReport rebuilds the running application instances of every app
+//  from the cloud controller app usage events and works out the daily peak,
+//  time weighted average and 95th percentile per foundation, org and space
+func GenAIUsageReport(client *cfclient.Client, start time.Time, end time.Time) (*AIUsage, error) {
+	timelines, err := GetAppInstanceTimelines(client)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't rebuild application instances")
+	}
+
+	orgs, err := client.ListOrgs()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
+	}
+	orgNames := map[string]string{}
+	for _, org := range orgs {
+		orgNames[org.Guid] = org.Name
+	}
+
+	// days are UTC like the usage service, and never run past now
+	from := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	to := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	if now := time.Now().UTC(); to.After(now) {
+		to = now
+	}
+	if !from.Before(to) {
+		return nil, stacktrace.NewError("Date range %s has not started yet", GenDateRange(start, end))
+	}
+
+	// sum the apps into their foundation, org and space
+	scopes := map[string]*scopeInstances{}
+	var scopeKeys []string
+	scope := func(key string, row FlattenAIUsage) *scopeInstances {
+		if s, found := scopes[key]; found {
+			return s
+		}
+		scopes[key] = &scopeInstances{row: row}
+		scopeKeys = append(scopeKeys, key)
+		return scopes[key]
+	}
+	scope(foundationScope, FlattenAIUsage{Scope: foundationScope})
+
+	appGUIDs := make([]string, 0, len(timelines))
+	for guid := range timelines {
+		appGUIDs = append(appGUIDs, guid)
+	}
+	sort.Strings(appGUIDs)
+
+	for _, guid := range appGUIDs {
+		timeline := timelines[guid]
+		appScopes := []*scopeInstances{
+			scopes[foundationScope],
+			scope(orgScope+"/"+timeline.orgGUID, FlattenAIUsage{
+				Scope:            orgScope,
+				OrganizationGUID: timeline.orgGUID,
+				OrgName:          orgNames[timeline.orgGUID],
+			}),
+			scope(spaceScope+"/"+timeline.spaceGUID, FlattenAIUsage{
+				Scope:            spaceScope,
+				OrganizationGUID: timeline.orgGUID,
+				OrgName:          orgNames[timeline.orgGUID],
+				SpaceGUID:        timeline.spaceGUID,
+				SpaceName:        timeline.spaceName,
+			}),
+		}
+
+		initial := timeline.instancesAt(from)
+		previous := initial
+		var deltas []instanceDelta
+		for _, change := range timeline.changes {
+			if !change.at.After(from) || !change.at.Before(to) {
+				continue
+			}
+			deltas = append(deltas, instanceDelta{at: change.at, delta: change.instances - previous})
+			previous = change.instances
+		}
+		for _, s := range appScopes {
+			s.initial += initial
+			s.deltas = append(s.deltas, deltas...)
+		}
+	}
+
+	for _, s := range scopes {
+		sort.SliceStable(s.deltas, func(i, j int) bool { return s.deltas[i].at.Before(s.deltas[j].at) })
+	}
+
+	report := AIUsage{}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		dayEnd := day.AddDate(0, 0, 1)
+		if dayEnd.After(to) {
+			dayEnd = to
+		}
+		for _, key := range scopeKeys {
+			s := scopes[key]
+			row := s.row
+			row.Date = day.Format(dateFormat)
+			row.PeakInstances, row.AverageInstances, row.P95Instances = s.stats(day, dayEnd)
+			report.Days = append(report.Days, row)
+		}
+	}
+	return &report, nil
+}
+
+// stats peak, time weighted average and 95th percentile of the running
+//  instances between from and to, deltas must be sorted by time
+func (s *scopeInstances) stats(from time.Time, to time.Time) (int, float64, int) {
+	// running instances at the start of the window
+	instances := s.initial
+	i := 0
+	for ; i < len(s.deltas) && !s.deltas[i].at.After(from); i++ {
+		instances += s.deltas[i].delta
+	}
+
+	type segment struct {
+		instances int
+		duration  time.Duration
+	}
+	var segments []segment
+	at := from
+	for ; i < len(s.deltas) && s.deltas[i].at.Before(to); i++ {
+		segments = append(segments, segment{instances, s.deltas[i].at.Sub(at)})
+		instances += s.deltas[i].delta
+		at = s.deltas[i].at
+	}
+	segments = append(segments, segment{instances, to.Sub(at)})
+
+	peak := 0
+	var weighted float64
+	var total time.Duration
+	for _, seg := range segments {
+		if seg.instances > peak {
+			peak = seg.instances
+		}
+		weighted += float64(seg.instances) * seg.duration.Seconds()
+		total += seg.duration
+	}
+	if total == 0 {
+		return peak, float64(peak), peak
+	}
+
+	// smallest instance count the scope stayed at or under for 95% of the time
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].instances < segments[j].instances })
+	p95 := peak
+	var covered time.Duration
+	for _, seg := range segments {
+		covered += seg.duration
+		if covered.Seconds() >= 0.95*total.Seconds() {
+			p95 = seg.instances
+			break
+		}
+	}
+	return peak, weighted / total.Seconds(), p95
+}
+
+// GetAppInstanceTimelines rebuilds the running instances of every app, keyed
+//  by app guid, from the app usage events, which are only paged in since the
+//  last call; apps with no events have been running unchanged and are taken
+//  from their current state
+func GetAppInstanceTimelines(client *cfclient.Client) (map[string]*appInstanceTimeline, error) {
+	events, err := usageEvents.AppEvents(client)
+	if err != nil {
+		return nil, err
+	}
+
+	timelines := map[string]*appInstanceTimeline{}
+	for _, event := range events {
+		// only starts and stops change the running instances, tasks are reported separately
+		if event.State != "STARTED" && event.State != "STOPPED" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, event.CreatedAt)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Improper created_at on app usage event %s", event.GUID)
+		}
+
+		timeline, found := timelines[event.AppGUID]
+		if !found {
+			// the state before the first event we know of
+			timeline = &appInstanceTimeline{orgGUID: event.OrgGUID, spaceGUID: event.SpaceGUID}
+			if event.PreviousState == "STARTED" {
+				timeline.initial = event.PreviousInstanceCount
+			}
+			timelines[event.AppGUID] = timeline
+		}
+		timeline.spaceName = event.SpaceName
+
+		instances := 0
+		if event.State == "STARTED" {
+			instances = event.InstanceCount
+		}
+		timeline.changes = append(timeline.changes, instanceChange{at: at, instances: instances})
+	}
+	for _, timeline := range timelines {
+		sort.SliceStable(timeline.changes, func(i, j int) bool { return timeline.changes[i].at.Before(timeline.changes[j].at) })
+	}
+
+	// started apps the events have nothing on
+	query := url.Values{"results-per-page": {"100"}}
+	apps, err := client.ListAppsByQuery(query)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of apps using client: %v", client)
+	}
+	spaces, err := client.ListSpacesByQuery(query)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of spaces using client: %v", client)
+	}
+	spacesByGUID := map[string]cfclient.Space{}
+	for _, space := range spaces {
+		spacesByGUID[space.Guid] = space
+	}
+	for _, app := range apps {
+		if _, found := timelines[app.Guid]; found || app.State != "STARTED" {
+			continue
+		}
+		space := spacesByGUID[app.SpaceGuid]
+		timelines[app.Guid] = &appInstanceTimeline{
+			orgGUID:   space.OrganizationGuid,
+			spaceGUID: app.SpaceGuid,
+			spaceName: space.Name,
+			initial:   app.Instances,
+		}
+	}
+	return timelines, nil
+}
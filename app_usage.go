@@ -1,18 +1,14 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"strings"
 	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
-	"github.com/jszwec/csvutil"
 	"github.com/labstack/echo"
 	"github.com/palantir/stacktrace"
-	"github.com/parnurzeal/gorequest"
 )
 
 //AppUsage array of orgs usage
@@ -24,6 +20,7 @@ type AppUsage struct {
 type OrgAppUsage struct {
 	OrganizationGUID string    `json:"organization_guid" csv:"organization_guid"`
 	OrgName          string    `json:"organization_name" csv:"organization_name"`
+	OrgDeleted       bool      `json:"org_deleted" csv:"org_deleted"`
 	PeriodStart      time.Time `json:"period_start" csv:"period_start"`
 	PeriodEnd        time.Time `json:"period_end" csv:"period_end"`
 	AppUsages        []struct {
@@ -39,15 +36,19 @@ type OrgAppUsage struct {
 
 // FlattenAppUsage flattened data for simple response with repeated org info
 type FlattenAppUsage struct {
-	Orgs []FlattenOrgAppUsage `json:"app_usages" csv:"app_usages"`
+	Orgs   []FlattenOrgAppUsage `json:"app_usages" csv:"app_usages"`
+	Errors []OrgUsageError      `json:"errors,omitempty" csv:"-"`
 }
 
 // FlattenOrgAppUsage flattened data for simple response usage
 type FlattenOrgAppUsage struct {
 	OrganizationGUID      string    `json:"organization_guid" csv:"organization_guid"`
 	OrgName               string    `json:"organization_name" csv:"organization_name"`
+	OrgDeleted            bool      `json:"org_deleted" csv:"org_deleted"`
 	PeriodStart           time.Time `json:"period_start" csv:"period_start"`
 	PeriodEnd             time.Time `json:"period_end" csv:"period_end"`
+	BucketStart           string    `json:"bucket_start,omitempty" csv:"bucket_start" xlsx:"date"`
+	BucketEnd             string    `json:"bucket_end,omitempty" csv:"bucket_end" xlsx:"date"`
 	SpaceGUID             string    `json:"space_guid" csv:"space_guid"`
 	SpaceName             string    `json:"space_name" csv:"space_name"`
 	AppName               string    `json:"app_name" csv:"app_name"`
@@ -57,138 +58,173 @@ type FlattenOrgAppUsage struct {
 	DurationInSeconds     int       `json:"duration_in_seconds" csv:"duration_in_seconds"`
 }
 
-// handles report formatting if CSV is specified
+// handles report formatting if CSV, NDJSON, XLSX or FOCUS is specified, summing
+//  the rows per group when group_by is
 func appReportFormatter(c echo.Context, usageReport *FlattenAppUsage) error {
-	var format = strings.ToLower(c.QueryParam("format"))
-	if format == "csv" {
-		fmt.Println("csv output requested")
-		b, err := csvutil.Marshal(usageReport.Orgs)
-		if err != nil {
-			fmt.Println("error:", err)
+	groupBy, err := ParseGroupBy(c, appGroupKeys)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	var format = reportFormat(c)
+	if format == focusFormat {
+		if len(groupBy) > 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "group_by can't be used with format=focus")
 		}
-		return c.String(http.StatusOK, string(b))
-	} else {
-		return c.JSON(http.StatusOK, usageReport)
+		return focusFormatter(c, FocusAppUsage(rateCard, usageReport.Orgs), usageReport.Errors)
+	}
+	if len(groupBy) > 0 {
+		return groupReportFormatter(c, GroupAppUsage(usageReport, groupBy))
 	}
-}
-
-// AppUsageReportByRange handle a start and end date in the call
-//  /app-usage?start=2017-11-01&end=2017-11-03
-func AppUsageReportByRange(c echo.Context) error {
 
-	// format the date range
-	fmt.Println("Start date is '" + c.QueryParam("start") + "'")
-	start, err := time.Parse(dateFormat, c.QueryParam("start"))
-	if err != nil {
-		return stacktrace.Propagate(err, "Improper start date provided in the URL")
+	if format == "xlsx" {
+		return xlsxFormatter(c, usageReport.Errors, appUsageSheets(usageReport)...)
 	}
-	end, err := time.Parse(dateFormat, c.QueryParam("end"))
-	if err != nil {
-		return stacktrace.Propagate(err, "Improper end date provided in the URL")
+	if format == "csv" || format == "ndjson" {
+		return newRowStream(c, format, FlattenOrgAppUsage{}).WriteAll(usageReport.Orgs, usageReport.Errors)
+	} else {
+		return jsonFormatter(c, usageReport)
 	}
+}
 
-	// format the start and end string
-	dateRange := GenDateRange(start, end)
-	fmt.Println("Date range is ", dateRange)
-
-	// Generate the report for all orgs
-	usageReport, err := GenAppUsageReport(cfClient, dateRange)
+// appUsageReport generates the app usage report for all orgs over the range
+//  /app-usage?start=2017-11-01&end=2017-11-03, /app-usage/yesterday
+func appUsageReport(c echo.Context, start time.Time, end time.Time) error {
+	opts, err := GetReportOptions(c)
 	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get app usage report for yesterday")
+		return err
 	}
-
-	// return report
-	return appReportFormatter(c, usageReport)
+	return runAppUsageReport(c, start, end, opts)
 }
 
-// AppUsageReportForToday handles the static nature of Apptio's Datalink
-//  in order to gather app usage data for the previous day
-func AppUsageReportForToday(c echo.Context) error {
-	// format the date range
-	dateToday := time.Now().Local()
-
-	// format the start and end string
-	dateRange := GenDateRange(dateToday, dateToday)
-	fmt.Println("Date range is ", dateRange)
+// runAppUsageReport generates the app usage report with the options, streaming the rows
+//  or formatting the whole report
+func runAppUsageReport(c echo.Context, start time.Time, end time.Time, opts ReportOptions) error {
+	// stream the rows as each org's usage comes back
+	if format := streamFormat(c); format != "" {
+		stream := newRowStream(c, format, FlattenOrgAppUsage{})
+		opts.Stream = stream.Write
+		usageReport, err := appUsageForRange(c.Request().Context(), start, end, opts)
+		if err != nil {
+			return stream.Fail(stacktrace.Propagate(err, "Couldn't get app usage report for range"))
+		}
+		return stream.Close(usageReport.Errors)
+	}
 
-	// Generate the report for all orgs
-	usageReport, err := GenAppUsageReport(cfClient, dateRange)
+	usageReport, err := appUsageForRange(c.Request().Context(), start, end, opts)
 	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get app usage report for yesterday")
+		return stacktrace.Propagate(err, "Couldn't get app usage report for range")
 	}
 
 	// return report
 	return appReportFormatter(c, usageReport)
 }
 
-// AppUsageReportForYesterday handles the static nature of Apptio's Datalink
-//  in order to gather app usage data for the previous day
-func AppUsageReportForYesterday(c echo.Context) error {
-	// format the date range
-	dateToday := time.Now().Local()
-	dateYesterday := dateToday.AddDate(0, 0, -1)
-
-	// format the start and end string
-	dateRange := GenDateRange(dateYesterday, dateYesterday)
-	fmt.Println("Date range is ", dateRange)
+// appUsageForRange reports on the range as a whole, or bucket by bucket
+//  tagging each row with its bucket when a granularity is requested
+func appUsageForRange(ctx context.Context, start time.Time, end time.Time, opts ReportOptions) (*FlattenAppUsage, error) {
+	if opts.Granularity == "" {
+		return appUsageForPeriod(ctx, start, end, opts)
+	}
 
-	// Generate the report for all orgs
-	usageReport, err := GenAppUsageReport(cfClient, dateRange)
+	buckets, err := SplitDateRange(start, end, opts.Granularity)
 	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get app usage report for yesterday")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// list the orgs once for the whole range rather than for each bucket
+	if opts.Orgs == nil {
+		if opts.Orgs, err = ListReportOrgs(CfClient(), start, end); err != nil {
+			return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", CfClient())
+		}
 	}
+	report := &FlattenAppUsage{}
+	for _, bucket := range buckets {
+		bucketStart, bucketEnd := bucket.Start.Format(dateFormat), bucket.End.Format(dateFormat)
+		tag := func(rows []FlattenOrgAppUsage) {
+			for i := range rows {
+				rows[i].BucketStart, rows[i].BucketEnd = bucketStart, bucketEnd
+			}
+		}
+		bucketOpts := opts
+		if opts.Stream != nil {
+			bucketOpts.Stream = func(rows interface{}) error {
+				tag(rows.([]FlattenOrgAppUsage))
+				return opts.Stream(rows)
+			}
+		}
 
-	// return report
-	return appReportFormatter(c, usageReport)
+		bucketReport, err := appUsageForPeriod(ctx, bucket.Start, bucket.End, bucketOpts)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Couldn't get app usage for bucket %s", GenDateRange(bucket.Start, bucket.End))
+		}
+		tag(bucketReport.Orgs)
+		report.Orgs = append(report.Orgs, bucketReport.Orgs...)
+		report.Errors = append(report.Errors, bucketReport.Errors...)
+	}
+	return report, nil
 }
 
-// AppUsageReportForMonth handles the app-usage call validating the date
-//  and executing the report creation
-func AppUsageReportForMonth(c echo.Context) error {
-
-	// first day of month and today's date
-	dateToday := time.Now().Local()
-	currentYear, currentMonth, _ := dateToday.Date()
-	currentLocation := dateToday.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-
-	// format the start and end string
-	dateRange := GenDateRange(firstOfMonth, dateToday)
-	fmt.Println("Date range is ", dateRange)
-
-	// Generate the report for all orgs
-	usageReport, err := GenAppUsageReport(cfClient, dateRange)
-	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get app usage report for yesterday")
+// appUsageForPeriod serves the report from the usage store when every day
+//  in the period has been collected, otherwise from the usage service
+func appUsageForPeriod(ctx context.Context, start time.Time, end time.Time, opts ReportOptions) (*FlattenAppUsage, error) {
+	if usageStore != nil && usageStore.Covers(appUsageKind, start, end) {
+		fmt.Println("Serving app usage from the usage store")
+		usageReport, err := usageStore.AppUsage(start, end)
+		if err != nil {
+			return nil, err
+		}
+		opts.Filter.FilterAppUsage(usageReport)
+		if opts.Stream != nil {
+			if err := opts.Stream(usageReport.Orgs); err != nil {
+				return nil, err
+			}
+			usageReport.Orgs = nil
+		}
+		return usageReport, nil
 	}
-
-	// return report
-	return appReportFormatter(c, usageReport)
+	return GenAppUsageReport(ctx, CfClient(), start, end, opts)
 }
 
 // GenAppUsageReport pulls the entire report together
-func GenAppUsageReport(client *cfclient.Client, dateRange string) (*FlattenAppUsage, error) {
+func GenAppUsageReport(ctx context.Context, client *cfclient.Client, start time.Time, end time.Time, opts ReportOptions) (*FlattenAppUsage, error) {
 
-	// get a list of orgs within the foundation
-	orgs, err := client.ListOrgs()
+	// get a list of orgs within the foundation, including the deleted ones
+	//  that still have usage in the period
+	reportOrgs, err := opts.reportOrgs(client, start, end)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
 	}
+	orgs := opts.Filter.FilterOrgs(reportOrgs.Orgs)
+	deletedOrgs := reportOrgs.Deleted
+	dateRange := GenDateRange(start, end)
 
-	report := AppUsage{}
+	report := AppUsage{Orgs: make([]OrgAppUsage, len(orgs))}
 	token, err := client.GetToken()
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Failed getting token using client: %v", client)
 	}
 
-	// loop through orgs and get app usage report for each
-	for _, org := range orgs {
-		orgUsage, err := AppUsageForOrg(token, org, dateRange)
+	// get app usage report for each org, keeping the orgs in order
+	failures := make([]*OrgUsageError, len(orgs))
+	err = forEachOrg(ctx, orgs, func(ctx context.Context, i int, org cfclient.Org) error {
+		orgUsage, err := AppUsageForOrg(ctx, token, org, dateRange)
+		if err != nil && opts.Partial {
+			failure := newOrgUsageError(org, err)
+			failures[i] = &failure
+			return nil
+		}
 		if err != nil {
-			return nil, stacktrace.Propagate(err, "Failed getting app usage for org: "+org.Name)
+			return stacktrace.Propagate(err, "Failed getting app usage for org: %s", org.Name)
 		}
 		orgUsage.OrgName = org.Name
-		report.Orgs = append(report.Orgs, *orgUsage)
+		orgUsage.OrgDeleted = deletedOrgs[org.Guid]
+		if opts.Stream != nil {
+			return streamAppUsage(orgUsage, opts)
+		}
+		report.Orgs[i] = *orgUsage
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// flatten the complexity of report for ease of consumption
@@ -196,26 +232,31 @@ func GenAppUsageReport(client *cfclient.Client, dateRange string) (*FlattenAppUs
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Couldn't get app usage report")
 	}
+	flatReport.Errors = collectOrgUsageErrors(failures)
+	opts.Filter.FilterAppUsage(&flatReport)
 
 	return &flatReport, nil
 }
 
-// AppUsageForOrg queries apps manager app_usages API for the orgs app usage information
-func AppUsageForOrg(token string, org cfclient.Org, dateRange string) (*OrgAppUsage, error) {
-	usageAPI := os.Getenv("CF_USAGE_API")
-	target := &OrgAppUsage{}
-	request := gorequest.New()
-	resp, _, err := request.Get(usageAPI+"/organizations/"+org.Guid+"/app_usages?"+dateRange).
-		Set("Authorization", token).TLSClientConfig(&tls.Config{InsecureSkipVerify: cfSkipSsl}).
-		EndStruct(&target)
+// streamAppUsage flattens, filters and streams the app usage of a single org
+func streamAppUsage(orgUsage *OrgAppUsage, opts ReportOptions) error {
+	flatReport, err := GetFlattenedAppOutput(&AppUsage{Orgs: []OrgAppUsage{*orgUsage}})
 	if err != nil {
-		return nil, stacktrace.Propagate(err[0], "Failed to get app usage report %v", org)
+		return stacktrace.Propagate(err, "Couldn't flatten app usage for org %s", orgUsage.OrgName)
 	}
-
-	if resp.StatusCode != 200 {
-		return nil, stacktrace.NewError("Failed getting app usage report %v", resp)
+	opts.Filter.FilterAppUsage(&flatReport)
+	if len(flatReport.Orgs) == 0 {
+		return nil
 	}
+	return opts.Stream(flatReport.Orgs)
+}
 
+// AppUsageForOrg queries apps manager app_usages API for the orgs app usage information
+func AppUsageForOrg(ctx context.Context, token string, org cfclient.Org, dateRange string) (*OrgAppUsage, error) {
+	target := &OrgAppUsage{}
+	if err := getOrgUsage(ctx, token, org, "app_usages", dateRange, target); err != nil {
+		return nil, stacktrace.Propagate(err, "Failed to get app usage report for org %s", org.Name)
+	}
 	return target, nil
 }
 
@@ -229,6 +270,7 @@ func GetFlattenedAppOutput(usageReport *AppUsage) (FlattenAppUsage, error) {
 			appusage := FlattenOrgAppUsage{
 				OrganizationGUID:      orgs.OrganizationGUID,
 				OrgName:               orgs.OrgName,
+				OrgDeleted:            orgs.OrgDeleted,
 				PeriodStart:           orgs.PeriodStart,
 				PeriodEnd:             orgs.PeriodEnd,
 				SpaceGUID:             app.SpaceGUID,
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// granularities a report range can be split into
+const (
+	dayGranularity   = "day"
+	weekGranularity  = "week"
+	monthGranularity = "month"
+)
+
+// DateBucket one day, week or month of a report range
+type DateBucket struct {
+	Start time.Time
+	End   time.Time
+}
+
+// SplitDateRange splits the range into day, week or month buckets, weeks
+//  starting on Monday, with the first and last bucket cut to the range
+func SplitDateRange(start time.Time, end time.Time, granularity string) ([]DateBucket, error) {
+	if end.Before(start) {
+		return nil, stacktrace.NewError("End date %s is before start date %s", end.Format(dateFormat), start.Format(dateFormat))
+	}
+
+	var buckets []DateBucket
+	for bucketStart := start; !bucketStart.After(end); {
+		var next time.Time
+		switch granularity {
+		case dayGranularity:
+			next = bucketStart.AddDate(0, 0, 1)
+		case weekGranularity:
+			daysToMonday := (8 - int(bucketStart.Weekday())) % 7
+			if daysToMonday == 0 {
+				daysToMonday = 7
+			}
+			next = bucketStart.AddDate(0, 0, daysToMonday)
+		case monthGranularity:
+			year, month, _ := bucketStart.Date()
+			next = time.Date(year, month+1, 1, 0, 0, 0, 0, bucketStart.Location())
+		default:
+			return nil, stacktrace.NewError("Granularity must be day, week or month, not '%s'", granularity)
+		}
+
+		bucketEnd := next.AddDate(0, 0, -1)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		buckets = append(buckets, DateBucket{Start: bucketStart, End: bucketEnd})
+		bucketStart = next
+	}
+	return buckets, nil
+}
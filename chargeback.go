@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// wildcard plan name in the rate card matching every plan of a service
+const anyServicePlan = "*"
+
+// RateCard prices used to charge orgs for their usage, loaded from RATE_CARD_FILE
+//  {"currency": "USD", "memory_gb_hour": 0.01, "instance_hour": 0.002,
+//   "service_plans": {"p-mysql": {"100mb": 0.02, "*": 0.01}}}
+type RateCard struct {
+	Currency     string                        `json:"currency"`
+	MemoryGBHour float64                       `json:"memory_gb_hour"`
+	InstanceHour float64                       `json:"instance_hour"`
+	ServicePlans map[string]map[string]float64 `json:"service_plans"`
+}
+
+// rateCard is nil unless RATE_CARD_FILE is set
+var rateCard *RateCard
+
+// ChargebackAppUsage flattened app usage row with its cost
+type ChargebackAppUsage struct {
+	FlattenOrgAppUsage
+	MemoryGBHours float64 `json:"memory_gb_hours" csv:"memory_gb_hours"`
+	InstanceHours float64 `json:"instance_hours" csv:"instance_hours"`
+	MemoryCost    float64 `json:"memory_cost" csv:"memory_cost"`
+	InstanceCost  float64 `json:"instance_cost" csv:"instance_cost"`
+	Cost          float64 `json:"cost" csv:"cost"`
+}
+
+// ChargebackServiceUsage flattened service usage row, already priced by
+//  ServicePricer from the marketplace or the rate card
+type ChargebackServiceUsage struct {
+	FlattenOrgServiceUsage
+	Hours float64 `json:"hours" csv:"hours"`
+}
+
+// ChargebackTotal cost of an org, or of a space when SpaceGUID is set
+type ChargebackTotal struct {
+	OrganizationGUID string  `json:"organization_guid" csv:"organization_guid"`
+	OrgName          string  `json:"organization_name" csv:"organization_name"`
+	SpaceGUID        string  `json:"space_guid,omitempty" csv:"space_guid"`
+	SpaceName        string  `json:"space_name,omitempty" csv:"space_name"`
+	AppCost          float64 `json:"app_cost" csv:"app_cost"`
+	ServiceCost      float64 `json:"service_cost" csv:"service_cost"`
+	Cost             float64 `json:"cost" csv:"cost"`
+}
+
+// Chargeback priced app and service usage with org and space totals
+type Chargeback struct {
+	Currency      string                   `json:"currency"`
+	PeriodStart   string                   `json:"period_start"`
+	PeriodEnd     string                   `json:"period_end"`
+	Cost          float64                  `json:"cost"`
+	Orgs          []ChargebackTotal        `json:"orgs"`
+	Spaces        []ChargebackTotal        `json:"spaces"`
+	AppUsages     []ChargebackAppUsage     `json:"app_usages"`
+	ServiceUsages []ChargebackServiceUsage `json:"service_usages"`
+	Errors        []OrgUsageError          `json:"errors,omitempty"`
+}
+
+// LoadRateCard reads the rate card from a JSON file
+func LoadRateCard(path string) (*RateCard, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't read rate card %s", path)
+	}
+	card := &RateCard{}
+	if err := json.Unmarshal(b, card); err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't parse rate card %s", path)
+	}
+	card.Currency = strings.ToUpper(card.Currency)
+	return card, nil
+}
+
+// ServicePlanRate hourly price of a service plan, falling back to the
+//  service's wildcard plan and then to free
+func (r *RateCard) ServicePlanRate(serviceName string, planName string) float64 {
+	plans, found := r.ServicePlans[serviceName]
+	if !found {
+		return 0
+	}
+	if rate, found := plans[planName]; found {
+		return rate
+	}
+	return plans[anyServicePlan]
+}
+
+// handles chargeback formatting if CSV, NDJSON, XLSX or FOCUS is specified,
+//  section picks the part of the report since CSV and NDJSON only hold one
+//  table, while XLSX has a sheet for each and FOCUS charges apps and services
+//  alike
+//  /chargeback/thismonth?format=csv&section=spaces
+func chargebackReportFormatter(c echo.Context, report *Chargeback) error {
+	var format = reportFormat(c)
+	if format == "xlsx" {
+		return xlsxFormatter(c, report.Errors,
+			xlsxSheet{"Orgs", report.Orgs},
+			xlsxSheet{"Spaces", report.Spaces},
+			xlsxSheet{"Apps", report.AppUsages},
+			xlsxSheet{"Services", report.ServiceUsages},
+		)
+	}
+	if format == focusFormat {
+		return focusFormatter(c, report.FocusRows(), report.Errors)
+	}
+	if format != "csv" && format != "ndjson" {
+		return jsonFormatter(c, report)
+	}
+
+	var rows interface{}
+	switch strings.ToLower(c.QueryParam("section")) {
+	case "", "orgs":
+		rows = report.Orgs
+	case "spaces":
+		rows = report.Spaces
+	case "apps":
+		rows = report.AppUsages
+	case "services":
+		rows = report.ServiceUsages
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "section must be orgs, spaces, apps or services")
+	}
+	return newRowStream(c, format, nil).WriteAll(rows, report.Errors)
+}
+
+// chargebackReport gathers app and service usage for the range and prices it
+//  /chargeback?start=2017-11-01&end=2017-11-30, /chargeback/lastmonth
+func chargebackReport(c echo.Context, start time.Time, end time.Time) error {
+	opts, err := GetReportOptions(c)
+	if err != nil {
+		return err
+	}
+
+	// the app and service usage cover the same orgs, list them once
+	if opts.Orgs, err = ListReportOrgs(CfClient(), start, end); err != nil {
+		return stacktrace.Propagate(err, "Couldn't list the orgs for the chargeback")
+	}
+	appUsage, err := appUsageForRange(c.Request().Context(), start, end, opts)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't get app usage report for chargeback")
+	}
+	serviceUsage, err := serviceUsageForRange(c.Request().Context(), start, end, opts)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't get service usage report for chargeback")
+	}
+
+	report := GenChargeback(rateCard, appUsage, serviceUsage)
+	report.PeriodStart = start.Format(dateFormat)
+	report.PeriodEnd = end.Format(dateFormat)
+	return chargebackReportFormatter(c, report)
+}
+
+// FocusRows the priced app and service usage as FOCUS charges
+func (r *Chargeback) FocusRows() []FocusRow {
+	apps := make([]FlattenOrgAppUsage, 0, len(r.AppUsages))
+	for _, app := range r.AppUsages {
+		apps = append(apps, app.FlattenOrgAppUsage)
+	}
+	services := make([]FlattenOrgServiceUsage, 0, len(r.ServiceUsages))
+	for _, service := range r.ServiceUsages {
+		services = append(services, service.FlattenOrgServiceUsage)
+	}
+	return append(FocusAppUsage(rateCard, apps), FocusServiceUsage(services)...)
+}
+
+// chargebackTotals org or space totals kept in the order they were first seen
+type chargebackTotals struct {
+	order  []string
+	totals map[string]*ChargebackTotal
+}
+
+// get returns the running total for guid, starting it from row if new
+func (t *chargebackTotals) get(guid string, row ChargebackTotal) *ChargebackTotal {
+	if t.totals == nil {
+		t.totals = map[string]*ChargebackTotal{}
+	}
+	if total, found := t.totals[guid]; found {
+		return total
+	}
+	t.order = append(t.order, guid)
+	t.totals[guid] = &row
+	return &row
+}
+
+// list completes the totals, most expensive first the way finance reads them
+func (t *chargebackTotals) list() []ChargebackTotal {
+	var totals []ChargebackTotal
+	for _, guid := range t.order {
+		total := t.totals[guid]
+		total.Cost = total.AppCost + total.ServiceCost
+		totals = append(totals, *total)
+	}
+	sort.SliceStable(totals, func(i, j int) bool { return totals[i].Cost > totals[j].Cost })
+	return totals
+}
+
+// PriceAppUsage works out the memory GB-hours and instance hours of the app
+//  usage row and, unless the rate card is nil, what they cost
+func PriceAppUsage(card *RateCard, app FlattenOrgAppUsage) ChargebackAppUsage {
+	hours := float64(app.DurationInSeconds) / 3600
+	row := ChargebackAppUsage{
+		FlattenOrgAppUsage: app,
+		MemoryGBHours:      float64(app.MemoryInMbPerInstance) / 1024 * float64(app.InstanceCount) * hours,
+		InstanceHours:      float64(app.InstanceCount) * hours,
+	}
+	if card != nil {
+		row.MemoryCost = row.MemoryGBHours * card.MemoryGBHour
+		row.InstanceCost = row.InstanceHours * card.InstanceHour
+		row.Cost = row.MemoryCost + row.InstanceCost
+	}
+	return row
+}
+
+// GenChargeback prices every usage row and totals the costs per org and space
+func GenChargeback(card *RateCard, appUsage *FlattenAppUsage, serviceUsage *FlattenServiceUsage) *Chargeback {
+	report := &Chargeback{Currency: card.Currency}
+	var orgs, spaces chargebackTotals
+
+	for _, app := range appUsage.Orgs {
+		row := PriceAppUsage(card, app)
+		report.AppUsages = append(report.AppUsages, row)
+
+		orgs.get(app.OrganizationGUID, ChargebackTotal{OrganizationGUID: app.OrganizationGUID, OrgName: app.OrgName}).AppCost += row.Cost
+		spaces.get(app.SpaceGUID, ChargebackTotal{OrganizationGUID: app.OrganizationGUID, OrgName: app.OrgName, SpaceGUID: app.SpaceGUID, SpaceName: app.SpaceName}).AppCost += row.Cost
+		report.Cost += row.Cost
+	}
+
+	for _, service := range serviceUsage.Orgs {
+		row := ChargebackServiceUsage{
+			FlattenOrgServiceUsage: service,
+			Hours:                  float64(service.DurationInSeconds) / 3600,
+		}
+		report.ServiceUsages = append(report.ServiceUsages, row)
+
+		orgs.get(service.OrganizationGUID, ChargebackTotal{OrganizationGUID: service.OrganizationGUID, OrgName: service.OrgName}).ServiceCost += row.Cost
+		spaces.get(service.SpaceGUID, ChargebackTotal{OrganizationGUID: service.OrganizationGUID, OrgName: service.OrgName, SpaceGUID: service.SpaceGUID, SpaceName: service.SpaceName}).ServiceCost += row.Cost
+		report.Cost += row.Cost
+	}
+
+	report.Orgs = orgs.list()
+	report.Spaces = spaces.list()
+	report.Errors = append(report.Errors, appUsage.Errors...)
+	report.Errors = append(report.Errors, serviceUsage.Errors...)
+	return report
+}
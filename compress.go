@@ -0,0 +1,115 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// content types that are compressed already
+var precompressedTypes = []string{xlsxContentType, "application/zip", "application/gzip"}
+
+// flushWriteCloser a compressor that can push out what it holds so far
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter compresses the response with the encoding the caller
+//  accepts, deciding when the headers are written so precompressed
+//  content such as xlsx is sent as it is
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string
+	compressor flushWriteCloser
+}
+
+// Compress compresses responses with gzip or deflate when the caller's
+//  Accept-Encoding allows it, flushing the compressor along with the
+//  response so streamed reports still arrive org by org
+func Compress() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			addVary(c, echo.HeaderAcceptEncoding)
+			encoding := acceptedEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" {
+				return next(c)
+			}
+
+			writer := &compressWriter{ResponseWriter: res.Writer, encoding: encoding}
+			res.Writer = writer
+			defer func() {
+				writer.Close()
+				res.Writer = writer.ResponseWriter
+			}()
+			return next(c)
+		}
+	}
+}
+
+// acceptedEncoding the encoding the caller wants most, gzip or deflate, or
+//  empty when it takes neither
+func acceptedEncoding(header string) string {
+	for _, accepted := range parseQualityList(header) {
+		switch accepted.value {
+		case "gzip", "*":
+			return "gzip"
+		case "deflate":
+			return "deflate"
+		}
+	}
+	return ""
+}
+
+// WriteHeader starts compressing unless there is no body or it is
+//  compressed already
+func (w *compressWriter) WriteHeader(code int) {
+	header := w.Header()
+	compress := code != http.StatusNoContent && code != http.StatusNotModified &&
+		header.Get(echo.HeaderContentEncoding) == ""
+	for _, contentType := range precompressedTypes {
+		compress = compress && !strings.HasPrefix(header.Get(echo.HeaderContentType), contentType)
+	}
+
+	if compress {
+		header.Set(echo.HeaderContentEncoding, w.encoding)
+		header.Del(echo.HeaderContentLength)
+		if w.encoding == "gzip" {
+			w.compressor = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.compressor = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write compresses the body when compressing
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.compressor != nil {
+		return w.compressor.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends everything written so far to the caller
+func (w *compressWriter) Flush() {
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the compressed body
+func (w *compressWriter) Close() error {
+	if w.compressor == nil {
+		return nil
+	}
+	return w.compressor.Close()
+}
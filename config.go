@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config every setting of the app, read from the CONFIG_FILE JSON file and
+//  overridden by the bound config service and the environment variables,
+//  each key being the lower case name of its environment variable
+//  {"cf_api": "https://api.system.mypcf.net", "usage_concurrency": 16}
+type Config struct {
+	// server
+	ListenAddress string        `json:"listen_address"`
+	ReadTimeout   time.Duration `json:"read_timeout"`
+	WriteTimeout  time.Duration `json:"write_timeout"`
+	TLSCertFile   string        `json:"tls_cert_file"`
+	TLSKeyFile    string        `json:"tls_key_file"`
+
+	// cloud foundry
+	CFAPI                 string        `json:"cf_api"`
+	CFUsageAPI            string        `json:"cf_usage_api"`
+	CFSkipSSLValidation   bool          `json:"cf_skip_ssl_validation"`
+	CFAdminUser           string        `json:"cf_admin_user"`
+	CFAdminPassword       string        `json:"cf_admin_password" secret:"true"`
+	CFClientID            string        `json:"cf_client_id"`
+	CFClientSecret        string        `json:"cf_client_secret" secret:"true"`
+	CFCredentialsFile     string        `json:"cf_credentials_file"`
+	CFCredentialsInterval time.Duration `json:"cf_credentials_interval"`
+	UsageTimeout          time.Duration `json:"usage_timeout"`
+	UsageConcurrency      int           `json:"usage_concurrency"`
+
+	// caller authentication
+	EnableBasicAuth bool   `json:"enable_basic_auth"`
+	BasicUsername   string `json:"basic_username"`
+	BasicPassword   string `json:"basic_password" secret:"true"`
+	EnableUAAAuth   bool   `json:"enable_uaa_auth"`
+	UAAClientIDs    string `json:"uaa_client_ids"`
+
+	// features
+	UsageStoreDir      string        `json:"usage_store_dir"`
+	UsageStoreDays     int           `json:"usage_store_days"`
+	UsageStoreInterval time.Duration `json:"usage_store_interval"`
+	IncludeDeletedOrgs bool          `json:"include_deleted_orgs"`
+	EnablePlanPricing  bool          `json:"enable_plan_pricing"`
+	RateCardFile       string        `json:"rate_card_file"`
+	FiscalYearStart    int           `json:"fiscal_year_start"`
+
+	// snapshots
+	SnapshotDir          string `json:"snapshot_dir"`
+	SnapshotScheduleFile string `json:"snapshot_schedule_file"`
+
+	// metrics
+	EnableMetrics   bool          `json:"enable_metrics"`
+	MetricsInterval time.Duration `json:"metrics_interval"`
+
+	// where each setting came from, by setting name
+	sources map[string]string
+}
+
+// DefaultConfig the settings used when nothing else sets them, listening on
+//  the PORT cloud foundry assigns
+func DefaultConfig() *Config {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return &Config{
+		ListenAddress:         ":" + port,
+		CFCredentialsInterval: defaultCredentialsInterval,
+		UsageConcurrency:      defaultUsageConcurrency,
+		UsageStoreDays:        defaultUsageStoreDays,
+		UsageStoreInterval:    defaultUsageStoreInterval,
+		FiscalYearStart:       int(time.January),
+		MetricsInterval:       defaultMetricsInterval,
+		UAAClientIDs:          defaultUAAClientIDs,
+		sources:               map[string]string{},
+	}
+}
+
+// LoadConfig reads the configuration file, when there is one, then the bound
+//  config service and environment overrides, returning every problem found
+func LoadConfig(path string) (*Config, []string) {
+	config := DefaultConfig()
+	var problems []string
+
+	if path != "" {
+		values := map[string]interface{}{}
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			// keep numbers as written, 1000000 rather than 1e+06
+			decoder := json.NewDecoder(bytes.NewReader(b))
+			decoder.UseNumber()
+			err = decoder.Decode(&values)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Couldn't read config file %s: %v", path, err))
+		}
+		known := map[string]bool{}
+		config.eachSetting(func(name string, field reflect.Value, secret bool) {
+			key := strings.ToLower(name)
+			known[key] = true
+			if value, found := values[key]; found {
+				// a bare number would be read as nanoseconds
+				if number, isNumber := value.(json.Number); isNumber && field.Type() == reflect.TypeOf(time.Duration(0)) {
+					problems = append(problems, fmt.Sprintf("%s in %s: must be a duration string such as \"1h\" or \"30s\", not the number %s", key, path, number))
+				} else if err := setConfigField(field, fmt.Sprint(value)); err != nil {
+					problems = append(problems, fmt.Sprintf("%s in %s: %v", key, path, err))
+				}
+				config.sources[name] = "config file"
+			}
+		})
+		for key := range values {
+			if !known[key] {
+				problems = append(problems, fmt.Sprintf("Unknown setting %s in %s", key, path))
+			}
+		}
+	}
+
+	config.eachSetting(func(name string, field reflect.Value, secret bool) {
+		if value := GetSetting(name); value != "" {
+			if err := setConfigField(field, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+			config.sources[name] = settingSource(name)
+		}
+	})
+
+	return config, append(problems, config.Validate()...)
+}
+
+// eachSetting calls fn with the setting name, the field and whether it is
+//  secret for every setting of the config
+func (config *Config) eachSetting(fn func(name string, field reflect.Value, secret bool)) {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("json") == "" {
+			continue
+		}
+		fn(strings.ToUpper(f.Tag.Get("json")), v.Field(i), f.Tag.Get("secret") == "true")
+	}
+}
+
+// setConfigField parses the text form of a setting into the field
+func setConfigField(field reflect.Value, value string) error {
+	switch target := field.Addr().Interface().(type) {
+	case *string:
+		*target = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false, not '%s'", value)
+		}
+		*target = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be a whole number, not '%s'", value)
+		}
+		*target = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 1h or 30s, not '%s'", value)
+		}
+		*target = d
+	}
+	return nil
+}
+
+// Credentials the Cloud Foundry credentials of the config
+func (config *Config) Credentials() CfCredentials {
+	return CfCredentials{
+		Username:     config.CFAdminUser,
+		Password:     config.CFAdminPassword,
+		ClientID:     config.CFClientID,
+		ClientSecret: config.CFClientSecret,
+	}
+}
+
+// Validate checks every setting, returning all of the problems rather than
+//  stopping at the first
+func (config *Config) Validate() []string {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if config.ListenAddress == "" {
+		problem("LISTEN_ADDRESS must be set")
+	}
+	if config.ReadTimeout < 0 || config.WriteTimeout < 0 || config.UsageTimeout < 0 {
+		problem("READ_TIMEOUT, WRITE_TIMEOUT and USAGE_TIMEOUT can't be negative")
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	for _, file := range []string{config.TLSCertFile, config.TLSKeyFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			problem("Couldn't read %s: %v", file, err)
+		}
+	}
+
+	if config.CFAPI == "" || config.CFUsageAPI == "" {
+		problem("Must set CF_API and CF_USAGE_API")
+	}
+	if config.CFCredentialsFile != "" {
+		if _, err := LoadCredentialsFile(config.CFCredentialsFile); err != nil {
+			problem("Couldn't load CF_CREDENTIALS_FILE: %v", err)
+		}
+		if config.CFCredentialsInterval <= 0 {
+			problem("CF_CREDENTIALS_INTERVAL must be a duration such as 1m")
+		}
+	} else if err := config.Credentials().Validate(); err != nil {
+		problem("%v", err)
+	}
+	if config.UsageConcurrency < 1 {
+		problem("USAGE_CONCURRENCY must be a positive number")
+	}
+
+	if config.EnableBasicAuth && (config.BasicUsername == "" || config.BasicPassword == "") {
+		problem("Must set BASIC_USERNAME and BASIC_PASSWORD when ENABLE_BASIC_AUTH is true")
+	}
+	if config.EnableUAAAuth && len(splitClientIDs(config.UAAClientIDs)) == 0 {
+		problem("Must set UAA_CLIENT_IDS when ENABLE_UAA_AUTH is true")
+	}
+
+	if config.UsageStoreDir != "" {
+		if config.UsageStoreDays < 1 {
+			problem("USAGE_STORE_DAYS must be a positive number")
+		}
+		if config.UsageStoreInterval <= 0 {
+			problem("USAGE_STORE_INTERVAL must be a duration such as 1h")
+		}
+	}
+	if config.RateCardFile != "" {
+		if _, err := LoadRateCard(config.RateCardFile); err != nil {
+			problem("Couldn't load RATE_CARD_FILE: %v", err)
+		}
+	}
+	if config.FiscalYearStart < 1 || config.FiscalYearStart > 12 {
+		problem("FISCAL_YEAR_START must be the number of a month, 1 to 12")
+	}
+
+	if config.SnapshotScheduleFile != "" {
+		if config.SnapshotDir == "" {
+			problem("Must set SNAPSHOT_DIR when SNAPSHOT_SCHEDULE_FILE is set")
+		}
+		if _, err := LoadSnapshotJobs(config.SnapshotScheduleFile); err != nil {
+			problem("Couldn't load SNAPSHOT_SCHEDULE_FILE: %v", err)
+		}
+	}
+
+	if config.EnableMetrics && config.MetricsInterval <= 0 {
+		problem("METRICS_INTERVAL must be a duration such as 15m")
+	}
+	return problems
+}
+
+// Log prints every setting and where it came from, redacting the secrets
+func (config *Config) Log() {
+	config.eachSetting(func(name string, field reflect.Value, secret bool) {
+		value := fmt.Sprint(field.Interface())
+		if secret && value != "" {
+			value = "[REDACTED]"
+		}
+		source, found := config.sources[name]
+		if !found {
+			source = "default"
+		}
+		fmt.Printf("%s=%s (%s)\n", name, value, source)
+	})
+}
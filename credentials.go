@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/palantir/stacktrace"
+)
+
+// default for how often the credentials file is checked for changes
+const defaultCredentialsInterval = time.Minute
+
+// CfCredentials the Auditor user, or the Auditor client, the app logs into
+//  Cloud Foundry with
+//  {"username": "pcf-auditor", "password": "auditor"}
+type CfCredentials struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// the credentials and client in use, both replaced when the credentials change
+var (
+	credentialsMu   sync.Mutex
+	cfCredentials   CfCredentials
+	currentCfClient atomic.Value
+	reloginMu       sync.Mutex
+)
+
+// Validate makes sure there is either a user and password or a client and secret
+func (creds CfCredentials) Validate() error {
+	if creds.ClientID != "" {
+		if creds.ClientSecret == "" {
+			return stacktrace.NewError("Must set environment variable CF_CLIENT_SECRET with CF_CLIENT_ID")
+		}
+		return nil
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return stacktrace.NewError("Must set environment variables CF_ADMIN_USER and CF_ADMIN_PASSWORD, or CF_CLIENT_ID and CF_CLIENT_SECRET")
+	}
+	return nil
+}
+
+// getCredentials the credentials currently in use
+func getCredentials() CfCredentials {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	return cfCredentials
+}
+
+// setCredentials replaces the credentials used on the next login
+func setCredentials(creds CfCredentials) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	cfCredentials = creds
+}
+
+// CfClient the client currently logged into Cloud Foundry
+func CfClient() *cfclient.Client {
+	client, _ := currentCfClient.Load().(*cfclient.Client)
+	return client
+}
+
+// LoadCredentialsFile reads the credentials from a JSON file
+func LoadCredentialsFile(path string) (CfCredentials, error) {
+	var creds CfCredentials
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return creds, stacktrace.Propagate(err, "Couldn't read credentials file %s", path)
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return creds, stacktrace.Propagate(err, "Couldn't parse credentials file %s", path)
+	}
+	return creds, creds.Validate()
+}
+
+// WatchCredentialsFile logs in again whenever the credentials file changes,
+//  keeping the current client when the new credentials don't work
+func WatchCredentialsFile(path string, interval time.Duration) {
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+	for {
+		time.Sleep(interval)
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Println("error:", err)
+			continue
+		}
+		if info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		creds, err := LoadCredentialsFile(path)
+		if err != nil {
+			fmt.Println("error:", err)
+			continue
+		}
+		client, err := NewCfClient(creds)
+		if err != nil {
+			fmt.Println("error: keeping the current client,", err)
+			continue
+		}
+		setCredentials(creds)
+		currentCfClient.Store(client)
+		fmt.Println("Logged in with the credentials changed in", path)
+	}
+}
+
+// RefreshCfToken logs in again after the usage service rejected the token,
+//  unless another request already has, and returns the new token
+func RefreshCfToken(rejected string) (string, error) {
+	reloginMu.Lock()
+	defer reloginMu.Unlock()
+
+	if token, err := CfClient().GetToken(); err == nil && token != rejected {
+		return token, nil
+	}
+	client, err := SetupCfClient()
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Couldn't log in again")
+	}
+	token, err := client.GetToken()
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Failed getting token using client: %v", client)
+	}
+	return token, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// CronSchedule the minutes a standard five field cron expression runs on,
+//  minute hour day-of-month month day-of-week, e.g. "0 2 * * *"
+type CronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// a restricted day of month or day of week, when both are restricted
+	//  either one matching is enough, as in cron
+	domRestricted, dowRestricted bool
+}
+
+// ParseCron parses a cron expression, each field being *, a number, a
+//  range such as 1-5, a list such as 1,15 and optionally a step such as */10
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, stacktrace.NewError("Cron expression '%s' must have 5 fields", expr)
+	}
+
+	schedule := &CronSchedule{
+		domRestricted: fields[2] != "*",
+		dowRestricted: fields[4] != "*",
+	}
+	var err error
+	for _, f := range []struct {
+		target   *map[int]bool
+		field    string
+		min, max int
+	}{
+		{&schedule.minute, fields[0], 0, 59},
+		{&schedule.hour, fields[1], 0, 23},
+		{&schedule.dom, fields[2], 1, 31},
+		{&schedule.month, fields[3], 1, 12},
+		{&schedule.dow, fields[4], 0, 7},
+	} {
+		if *f.target, err = parseCronField(f.field, f.min, f.max); err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid cron expression '%s'", expr)
+		}
+	}
+
+	// sunday is both 0 and 7
+	if schedule.dow[7] {
+		schedule.dow[0] = true
+	}
+	return schedule, nil
+}
+
+// parseCronField parses one field into the set of values it matches
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, stacktrace.NewError("Invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, stacktrace.NewError("Invalid value '%s'", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, stacktrace.NewError("Invalid range '%s'", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, stacktrace.NewError("'%s' is outside %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches reports whether the schedule runs at the minute of t
+func (s *CronSchedule) Matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/palantir/stacktrace"
+)
+
+// includeDeletedOrgs also reports on orgs deleted before the report runs
+var includeDeletedOrgs bool
+
+// ReportOrgs the orgs a report covers, the deleted ones being flagged
+type ReportOrgs struct {
+	Orgs    []cfclient.Org
+	Deleted map[string]bool
+}
+
+// ListReportOrgs lists the orgs to report on, adding the orgs that no longer
+//  exist but used apps or services during the period when
+//  INCLUDE_DELETED_ORGS is set; deleted orgs are flagged
+func ListReportOrgs(client *cfclient.Client, start time.Time, end time.Time) (*ReportOrgs, error) {
+	orgs, err := client.ListOrgs()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
+	}
+	reportOrgs := &ReportOrgs{Orgs: orgs, Deleted: map[string]bool{}}
+	if !includeDeletedOrgs {
+		return reportOrgs, nil
+	}
+
+	existing := map[string]bool{}
+	for _, org := range orgs {
+		existing[org.Guid] = true
+	}
+
+	active, err := listActiveOrgGUIDs(client, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, guid := range active {
+		if !existing[guid] {
+			missing = append(missing, guid)
+		}
+	}
+	if len(missing) == 0 {
+		return reportOrgs, nil
+	}
+
+	names, err := listDeletedOrgNames(client)
+	if err != nil {
+		return nil, err
+	}
+	for _, guid := range missing {
+		reportOrgs.Orgs = append(reportOrgs.Orgs, cfclient.Org{Guid: guid, Name: names[guid]})
+		reportOrgs.Deleted[guid] = true
+	}
+	return reportOrgs, nil
+}
+
+// listActiveOrgGUIDs finds every org that may have used apps or services
+//  during the period: the orgs with a usage event within it, and the orgs
+//  whose last event before it left an app running or a service instance in
+//  place, sorted so deleted orgs are always reported in the same order
+func listActiveOrgGUIDs(client *cfclient.Client, start time.Time, end time.Time) ([]string, error) {
+	// usage service days are UTC, the period running to the end of its last day
+	from := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	to := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	before := func(createdAt string) bool {
+		t, err := time.Parse(time.RFC3339, createdAt)
+		return err == nil && t.Before(from)
+	}
+	after := func(createdAt string) bool {
+		t, err := time.Parse(time.RFC3339, createdAt)
+		return err == nil && !t.Before(to)
+	}
+	guids := map[string]bool{}
+
+	// replay the starts and stops before the period to find the apps
+	//  running when it began
+	appEvents, err := usageEvents.AppEvents(client)
+	if err != nil {
+		return nil, err
+	}
+	runningApps := map[string]string{}
+	for _, event := range appEvents {
+		if after(event.CreatedAt) {
+			break
+		} else if !before(event.CreatedAt) {
+			guids[event.OrgGUID] = true
+		} else if event.State == "STARTED" {
+			runningApps[event.AppGUID] = event.OrgGUID
+		} else if event.State == "STOPPED" {
+			delete(runningApps, event.AppGUID)
+		}
+	}
+	for _, orgGUID := range runningApps {
+		guids[orgGUID] = true
+	}
+
+	// likewise the service instances not yet deleted when it began
+	serviceEvents, err := usageEvents.ServiceEvents(client)
+	if err != nil {
+		return nil, err
+	}
+	serviceInstances := map[string]string{}
+	for _, event := range serviceEvents {
+		if after(event.CreatedAt) {
+			break
+		} else if !before(event.CreatedAt) {
+			guids[event.OrgGUID] = true
+		} else if event.State == "DELETED" {
+			delete(serviceInstances, event.ServiceInstanceGUID)
+		} else {
+			serviceInstances[event.ServiceInstanceGUID] = event.OrgGUID
+		}
+	}
+	for _, orgGUID := range serviceInstances {
+		guids[orgGUID] = true
+	}
+
+	active := make([]string, 0, len(guids))
+	for guid := range guids {
+		if guid != "" {
+			active = append(active, guid)
+		}
+	}
+	sort.Strings(active)
+	return active, nil
+}
+
+// listDeletedOrgNames maps deleted org guids to the name they had when they
+//  were deleted, from the cloud controller audit events
+func listDeletedOrgNames(client *cfclient.Client) (map[string]string, error) {
+	events, err := client.ListEventsByQuery(url.Values{"q": {"type:audit.organization.delete-request"}})
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting org delete events using client: %v", client)
+	}
+	names := map[string]string{}
+	for _, event := range events {
+		names[event.Actee] = event.ActeeName
+	}
+	return names, nil
+}
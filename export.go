@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/jszwec/csvutil"
+	"github.com/palantir/stacktrace"
+)
+
+// RunExport writes a single report to a file, or to stdout, instead of
+//  serving them, so reports can run as a cf task or cron job
+//  cf-orgs-usage export --type app --start 2018-01-01 --end 2018-01-31 --format csv --out app-usage.csv
+//  cf-orgs-usage export --type service --period lastmonth
+func RunExport(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	reportType := flags.String("type", "app", "report to export: app, service or task")
+	startDate := flags.String("start", "", "first day of the report, YYYY-MM-DD, defaults to yesterday")
+	endDate := flags.String("end", "", "last day of the report, YYYY-MM-DD, defaults to the start")
+	period := flags.String("period", "", "named period such as lastmonth or lastquarter, instead of the dates")
+	format := flags.String("format", "json", "json, csv, xlsx or focus")
+	out := flags.String("out", "", "file to write, defaults to stdout")
+	partial := flags.Bool("partial", false, "export the orgs that succeeded when some fail")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" && *format != "xlsx" && *format != focusFormat {
+		return stacktrace.NewError("Format must be json, csv, xlsx or focus, not '%s'", *format)
+	}
+	if *period != "" && (*startDate != "" || *endDate != "") {
+		return stacktrace.NewError("Use either --period or --start and --end, not both")
+	}
+
+	// format the date range
+	start := time.Now().Local().AddDate(0, 0, -1)
+	if *startDate != "" {
+		var err error
+		if start, err = time.Parse(dateFormat, *startDate); err != nil {
+			return stacktrace.Propagate(err, "Improper start date %s", *startDate)
+		}
+	}
+	end := start
+	if *endDate != "" {
+		var err error
+		if end, err = time.Parse(dateFormat, *endDate); err != nil {
+			return stacktrace.Propagate(err, "Improper end date %s", *endDate)
+		}
+	}
+	if *period != "" {
+		var err error
+		if start, end, err = PeriodRange(*period, time.Now().Local()); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Date range is ", GenDateRange(start, end))
+
+	// generate the report
+	b, errs, err := GenReportFile(context.Background(), *reportType, start, end, *format, ReportOptions{Partial: *partial})
+	if err != nil {
+		return err
+	}
+	for _, failure := range errs {
+		fmt.Printf("Failed org %s: %d %s\n", failure.OrgName, failure.StatusCode, failure.Message)
+	}
+
+	if *out == "" {
+		_, err = stdout.Write(b)
+		return err
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		return stacktrace.Propagate(err, "Couldn't write %s", *out)
+	}
+	fmt.Println("Wrote", *out)
+	return nil
+}
+
+// GenReportFile generates an app, service or task usage report and formats
+//  it as json, csv, xlsx or, for app and service usage, focus, returning the
+//  orgs that failed separately since the others have nowhere to put them
+func GenReportFile(ctx context.Context, reportType string, start time.Time, end time.Time, format string, opts ReportOptions) ([]byte, []OrgUsageError, error) {
+	if format == focusFormat {
+		if strings.ToLower(reportType) == "task" {
+			return nil, nil, stacktrace.NewError("Only app and service usage can be exported as focus")
+		}
+		var err error
+		if opts.Granularity, err = focusGranularity(opts.Granularity); err != nil {
+			return nil, nil, err
+		}
+	}
+	var report interface{}
+	var rows interface{}
+	var sheets []xlsxSheet
+	var focusRows []FocusRow
+	var errs []OrgUsageError
+	switch strings.ToLower(reportType) {
+	case "app":
+		usageReport, err := appUsageForRange(ctx, start, end, opts)
+		if err != nil {
+			return nil, nil, stacktrace.Propagate(err, "Couldn't get app usage report")
+		}
+		report, rows, errs = usageReport, usageReport.Orgs, usageReport.Errors
+		sheets = appUsageSheets(usageReport)
+		focusRows = FocusAppUsage(rateCard, usageReport.Orgs)
+	case "service":
+		usageReport, err := serviceUsageForRange(ctx, start, end, opts)
+		if err != nil {
+			return nil, nil, stacktrace.Propagate(err, "Couldn't get service usage report")
+		}
+		report, rows, errs = usageReport, usageReport.Orgs, usageReport.Errors
+		sheets = serviceUsageSheets(usageReport)
+		focusRows = FocusServiceUsage(usageReport.Orgs)
+	case "task":
+		usageReport, err := GetTaskUsageReport(ctx, CfClient(), start, end, opts)
+		if err != nil {
+			return nil, nil, stacktrace.Propagate(err, "Couldn't get task usage report")
+		}
+		report, rows, errs = usageReport, usageReport.Orgs, usageReport.Errors
+		sheets = taskUsageSheets(usageReport)
+	default:
+		return nil, nil, stacktrace.NewError("Report type must be app, service or task, not '%s'", reportType)
+	}
+
+	var b []byte
+	var err error
+	switch format {
+	case "csv":
+		b, err = csvutil.Marshal(rows)
+	case "xlsx":
+		b, err = MarshalXLSX(sheets...)
+	case focusFormat:
+		b, err = csvutil.Marshal(focusRows)
+	default:
+		b, err = json.MarshalIndent(report, "", "  ")
+	}
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "Couldn't format the %s usage report", reportType)
+	}
+	return b, errs, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/labstack/echo"
+)
+
+// nameFilter matches a name or guid exactly, against a glob such as team-*,
+//  or against a regular expression between slashes such as /^team-(a|b)$/
+type nameFilter struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// UsageFilter narrows a report down to the matching orgs, spaces, apps,
+//  services and plans, the filters a report has no field for are ignored
+type UsageFilter struct {
+	Org     *nameFilter
+	Space   *nameFilter
+	App     *nameFilter
+	Service *nameFilter
+	Plan    *nameFilter
+
+	// Caller limits the report to the orgs the caller can see
+	Caller *Caller
+}
+
+// newNameFilter checks the pattern is a valid glob or regular expression,
+//  an empty pattern returns a nil filter matching everything
+func newNameFilter(param string, pattern string) (*nameFilter, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	filter := &nameFilter{pattern: pattern}
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid "+param+" regular expression: "+err.Error())
+		}
+		filter.re = re
+	} else if _, err := path.Match(pattern, ""); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid "+param+" pattern: "+err.Error())
+	}
+	return filter, nil
+}
+
+// match reports whether the name or guid matches, a nil filter matches everything
+func (f *nameFilter) match(name string, guid string) bool {
+	if f == nil {
+		return true
+	}
+	if f.re != nil {
+		return f.re.MatchString(name) || f.re.MatchString(guid)
+	}
+	if f.pattern == name || f.pattern == guid {
+		return true
+	}
+	matched, _ := path.Match(f.pattern, name)
+	return matched
+}
+
+// GetUsageFilter reads the filters from the query string
+//  /app-usage/thismonth?org=team-*&space=production
+func GetUsageFilter(c echo.Context) (UsageFilter, error) {
+	var filter UsageFilter
+	var err error
+	for _, f := range []struct {
+		param  string
+		target **nameFilter
+	}{
+		{"org", &filter.Org},
+		{"space", &filter.Space},
+		{"app", &filter.App},
+		{"service", &filter.Service},
+		{"plan", &filter.Plan},
+	} {
+		if *f.target, err = newNameFilter(f.param, c.QueryParam(f.param)); err != nil {
+			return UsageFilter{}, err
+		}
+	}
+	filter.Caller = GetCaller(c)
+	return filter, nil
+}
+
+// matchOrg reports whether the org is visible to the caller and matches the org filter
+func (f UsageFilter) matchOrg(name string, guid string) bool {
+	return f.Caller.CanSee(guid) && f.Org.match(name, guid)
+}
+
+// FilterOrgs keeps the orgs the caller can see matching the org filter, so
+//  the usage service is only asked about the orgs the report needs
+func (f UsageFilter) FilterOrgs(orgs []cfclient.Org) []cfclient.Org {
+	if f.Org == nil && f.Caller.SeesAll() {
+		return orgs
+	}
+	var matched []cfclient.Org
+	for _, org := range orgs {
+		if f.matchOrg(org.Name, org.Guid) {
+			matched = append(matched, org)
+		}
+	}
+	return matched
+}
+
+// FilterAppUsage keeps the app usage rows matching the org, space and app filters
+func (f UsageFilter) FilterAppUsage(usageReport *FlattenAppUsage) {
+	rows := usageReport.Orgs[:0]
+	for _, row := range usageReport.Orgs {
+		if f.matchOrg(row.OrgName, row.OrganizationGUID) &&
+			f.Space.match(row.SpaceName, row.SpaceGUID) &&
+			f.App.match(row.AppName, row.AppGUID) {
+			rows = append(rows, row)
+		}
+	}
+	usageReport.Orgs = rows
+}
+
+// FilterServiceUsage keeps the service usage rows matching the org, space,
+//  service and plan filters
+func (f UsageFilter) FilterServiceUsage(usageReport *FlattenServiceUsage) {
+	rows := usageReport.Orgs[:0]
+	for _, row := range usageReport.Orgs {
+		if f.matchOrg(row.OrgName, row.OrganizationGUID) &&
+			f.Space.match(row.SpaceName, row.SpaceGUID) &&
+			f.Service.match(row.ServiceName, row.ServiceGUID) &&
+			f.Plan.match(row.ServicePlanName, row.ServicePlanGUID) {
+			rows = append(rows, row)
+		}
+	}
+	usageReport.Orgs = rows
+}
+
+// FilterTaskUsage keeps the task usage rows matching the org, space and
+//  app filters, the app being the task's parent app
+func (f UsageFilter) FilterTaskUsage(usageReport *FlattenTaskUsage) {
+	rows := usageReport.Orgs[:0]
+	for _, row := range usageReport.Orgs {
+		if f.matchOrg(row.OrgName, row.OrganizationGUID) &&
+			f.Space.match(row.SpaceName, row.SpaceGUID) &&
+			f.App.match(row.ParentApplicationName, row.ParentApplicationGUID) {
+			rows = append(rows, row)
+		}
+	}
+	usageReport.Orgs = rows
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// values the FOCUS columns take for Cloud Foundry usage
+const (
+	focusFormat          = "focus"
+	focusProvider        = "Cloud Foundry"
+	focusTimeFormat      = "2006-01-02T15:04:05Z"
+	focusUsageCategory   = "Usage"
+	focusUsageFrequency  = "Usage-Based"
+	appMemorySku         = "app-memory-gb-hour"
+	appInstanceSku       = "app-instance-hour"
+	appServiceName       = "Application Runtime"
+	appResourceType      = "Application"
+	serviceResourceType  = "Service Instance"
+	hoursUsageUnit       = "Hours"
+	memoryGBHoursUnit    = "GB-Hours"
+	appServiceCategory   = "Compute"
+	otherServiceCategory = "Other"
+	defaultCurrency      = "USD"
+)
+
+// FOCUS service categories of the common brokers, the first whose keyword
+//  is in the service name applying
+var focusServiceCategories = []struct {
+	keyword  string
+	category string
+}{
+	{"mysql", "Databases"},
+	{"postgres", "Databases"},
+	{"redis", "Databases"},
+	{"mongo", "Databases"},
+	{"cassandra", "Databases"},
+	{"gemfire", "Databases"},
+	{"cloudcache", "Databases"},
+	{"rabbit", "Integration"},
+	{"kafka", "Integration"},
+	{"s3", "Storage"},
+	{"minio", "Storage"},
+	{"nfs", "Storage"},
+	{"smb", "Storage"},
+	{"elasticsearch", "Analytics"},
+	{"opensearch", "Analytics"},
+	{"sso", "Identity"},
+	{"identity", "Identity"},
+	{"credhub", "Security"},
+	{"config-server", "Developer Tools"},
+	{"service-registry", "Developer Tools"},
+}
+
+// FocusRow a charge in the columns of the FinOps Open Cost and Usage
+//  Specification, the foundation being the billing account, the org the
+//  sub account and the space added as x_ custom columns
+type FocusRow struct {
+	BillingAccountID   string  `json:"BillingAccountId" csv:"BillingAccountId"`
+	BillingAccountName string  `json:"BillingAccountName" csv:"BillingAccountName"`
+	BillingCurrency    string  `json:"BillingCurrency" csv:"BillingCurrency"`
+	BillingPeriodStart string  `json:"BillingPeriodStart" csv:"BillingPeriodStart"`
+	BillingPeriodEnd   string  `json:"BillingPeriodEnd" csv:"BillingPeriodEnd"`
+	ChargePeriodStart  string  `json:"ChargePeriodStart" csv:"ChargePeriodStart"`
+	ChargePeriodEnd    string  `json:"ChargePeriodEnd" csv:"ChargePeriodEnd"`
+	ChargeCategory     string  `json:"ChargeCategory" csv:"ChargeCategory"`
+	ChargeFrequency    string  `json:"ChargeFrequency" csv:"ChargeFrequency"`
+	ChargeDescription  string  `json:"ChargeDescription" csv:"ChargeDescription"`
+	BilledCost         float64 `json:"BilledCost" csv:"BilledCost"`
+	EffectiveCost      float64 `json:"EffectiveCost" csv:"EffectiveCost"`
+	ListCost           float64 `json:"ListCost" csv:"ListCost"`
+	ListUnitPrice      float64 `json:"ListUnitPrice" csv:"ListUnitPrice"`
+	PricingQuantity    float64 `json:"PricingQuantity" csv:"PricingQuantity"`
+	PricingUnit        string  `json:"PricingUnit" csv:"PricingUnit"`
+	UsageQuantity      float64 `json:"UsageQuantity" csv:"UsageQuantity"`
+	UsageUnit          string  `json:"UsageUnit" csv:"UsageUnit"`
+	ProviderName       string  `json:"ProviderName" csv:"ProviderName"`
+	PublisherName      string  `json:"PublisherName" csv:"PublisherName"`
+	InvoiceIssuerName  string  `json:"InvoiceIssuerName" csv:"InvoiceIssuerName"`
+	ResourceID         string  `json:"ResourceId" csv:"ResourceId"`
+	ResourceName       string  `json:"ResourceName" csv:"ResourceName"`
+	ResourceType       string  `json:"ResourceType" csv:"ResourceType"`
+	ServiceCategory    string  `json:"ServiceCategory" csv:"ServiceCategory"`
+	ServiceName        string  `json:"ServiceName" csv:"ServiceName"`
+	SkuID              string  `json:"SkuId" csv:"SkuId"`
+	SubAccountID       string  `json:"SubAccountId" csv:"SubAccountId"`
+	SubAccountName     string  `json:"SubAccountName" csv:"SubAccountName"`
+	SpaceGUID          string  `json:"x_SpaceId" csv:"x_SpaceId"`
+	SpaceName          string  `json:"x_SpaceName" csv:"x_SpaceName"`
+}
+
+// focusFormatter returns the rows as a FOCUS csv, listing failed orgs in
+//  the X-Usage-Errors header like csv
+func focusFormatter(c echo.Context, rows []FocusRow, errs []OrgUsageError) error {
+	return newRowStream(c, focusFormat, FocusRow{}).WriteAll(rows, errs)
+}
+
+// FocusAppUsage charges the memory GB-hours and the instance hours of each
+//  app usage row separately, priced from the rate card unless it is nil
+func FocusAppUsage(card *RateCard, rows []FlattenOrgAppUsage) []FocusRow {
+	focusRows := make([]FocusRow, 0, 2*len(rows))
+	for _, app := range rows {
+		priced := PriceAppUsage(card, app)
+		row := newFocusRow(app.OrganizationGUID, app.OrgName, app.SpaceGUID, app.SpaceName,
+			app.PeriodStart, app.PeriodEnd, app.BucketStart, app.BucketEnd)
+		row.ResourceID = app.AppGUID
+		row.ResourceName = app.AppName
+		row.ResourceType = appResourceType
+		row.ServiceCategory = appServiceCategory
+		row.ServiceName = appServiceName
+
+		memory, instances := row, row
+		memory.SkuID = appMemorySku
+		memory.ChargeDescription = "App memory GB-hours"
+		setFocusUsage(&memory, priced.MemoryGBHours, memoryGBHoursUnit, priced.MemoryCost)
+		instances.SkuID = appInstanceSku
+		instances.ChargeDescription = "App instance hours"
+		setFocusUsage(&instances, priced.InstanceHours, hoursUsageUnit, priced.InstanceCost)
+		currency := ""
+		if card != nil {
+			currency = card.Currency
+			memory.ListUnitPrice, instances.ListUnitPrice = card.MemoryGBHour, card.InstanceHour
+		}
+		memory.BillingCurrency, instances.BillingCurrency = focusCurrency(currency), focusCurrency(currency)
+		focusRows = append(focusRows, memory, instances)
+	}
+	return focusRows
+}
+
+// FocusServiceUsage charges the hours of each service usage row, at the
+//  price ServicePricer gave it if any, the plan being the SKU
+func FocusServiceUsage(rows []FlattenOrgServiceUsage) []FocusRow {
+	focusRows := make([]FocusRow, 0, len(rows))
+	for _, service := range rows {
+		row := newFocusRow(service.OrganizationGUID, service.OrgName, service.SpaceGUID, service.SpaceName,
+			service.PeriodStart, service.PeriodEnd, service.BucketStart, service.BucketEnd)
+		row.ResourceID = service.ServiceInstanceGUID
+		row.ResourceName = service.ServiceInstanceName
+		row.ResourceType = serviceResourceType
+		row.ServiceCategory = focusServiceCategory(service.ServiceName)
+		row.ServiceName = service.ServiceName
+		row.SkuID = service.ServicePlanGUID
+		row.ChargeDescription = service.ServiceName + " " + service.ServicePlanName + " instance hours"
+		row.BillingCurrency = focusCurrency(service.PlanCurrency)
+		row.ListUnitPrice = service.HourlyRate
+		setFocusUsage(&row, float64(service.DurationInSeconds)/3600, hoursUsageUnit, service.Cost)
+		focusRows = append(focusRows, row)
+	}
+	return focusRows
+}
+
+// focusCurrency the upper case ISO 4217 code FOCUS requires, the rate card
+//  currency when the row has none, or USD without a rate card
+func focusCurrency(currency string) string {
+	if currency == "" && rateCard != nil {
+		currency = rateCard.Currency
+	}
+	if currency == "" {
+		return defaultCurrency
+	}
+	return strings.ToUpper(currency)
+}
+
+// focusServiceCategory the FOCUS category of the service, Other when it
+//  isn't a broker we know
+func focusServiceCategory(serviceName string) string {
+	name := strings.ToLower(serviceName)
+	for _, known := range focusServiceCategories {
+		if strings.Contains(name, known.keyword) {
+			return known.category
+		}
+	}
+	return otherServiceCategory
+}
+
+// newFocusRow fills the account and period columns every charge has, the
+//  charge period being the bucket when the usage was split into buckets
+func newFocusRow(orgGUID string, orgName string, spaceGUID string, spaceName string, periodStart time.Time, periodEnd time.Time, bucketStart string, bucketEnd string) FocusRow {
+	chargeStart, chargeEnd := periodStart, periodEnd
+	if start, err := time.Parse(dateFormat, bucketStart); err == nil {
+		chargeStart = start
+	}
+	if end, err := time.Parse(dateFormat, bucketEnd); err == nil {
+		chargeEnd = end
+	}
+	chargeStart = focusDay(chargeStart, false)
+	chargeEnd = focusDay(chargeEnd, true)
+	billingStart := time.Date(chargeStart.Year(), chargeStart.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return FocusRow{
+		BillingAccountID:   cfAPI,
+		BillingAccountName: focusAccountName(),
+		BillingPeriodStart: billingStart.Format(focusTimeFormat),
+		BillingPeriodEnd:   billingStart.AddDate(0, 1, 0).Format(focusTimeFormat),
+		ChargePeriodStart:  chargeStart.Format(focusTimeFormat),
+		ChargePeriodEnd:    chargeEnd.Format(focusTimeFormat),
+		ChargeCategory:     focusUsageCategory,
+		ChargeFrequency:    focusUsageFrequency,
+		ProviderName:       focusProvider,
+		PublisherName:      focusProvider,
+		InvoiceIssuerName:  focusProvider,
+		SubAccountID:       orgGUID,
+		SubAccountName:     orgName,
+		SpaceGUID:          spaceGUID,
+		SpaceName:          spaceName,
+	}
+}
+
+// focusGranularity the buckets of a FOCUS report, months unless the usage
+//  is asked for by day, so no charge runs past the billing month it is in
+func focusGranularity(granularity string) (string, error) {
+	switch granularity {
+	case "":
+		return monthGranularity, nil
+	case weekGranularity:
+		return "", stacktrace.NewError("granularity=week can't be used with format=focus since weeks cross billing months")
+	}
+	return granularity, nil
+}
+
+// setFocusUsage sets the quantity used and its cost, which is billed at
+//  list price since there are no discounts
+func setFocusUsage(row *FocusRow, quantity float64, unit string, cost float64) {
+	row.UsageQuantity, row.UsageUnit = quantity, unit
+	row.PricingQuantity, row.PricingUnit = quantity, unit
+	row.BilledCost, row.EffectiveCost, row.ListCost = cost, cost, cost
+}
+
+// focusDay the start of the day in UTC, or for the last day of a period
+//  the start of the next day since FOCUS periods exclude their end
+func focusDay(t time.Time, end bool) time.Time {
+	year, month, day := t.UTC().Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if end {
+		return start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+// focusAccountName the host of the cloud controller naming the foundation
+func focusAccountName() string {
+	if u, err := url.Parse(cfAPI); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return cfAPI
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// fields usage rows can be grouped by
+const (
+	orgGroup     = "org"
+	spaceGroup   = "space"
+	appGroup     = "app"
+	serviceGroup = "service"
+	planGroup    = "plan"
+)
+
+// group_by values each report understands
+var (
+	appGroupKeys     = []string{orgGroup, spaceGroup, appGroup}
+	serviceGroupKeys = []string{orgGroup, spaceGroup, serviceGroup, planGroup}
+	taskGroupKeys    = []string{orgGroup, spaceGroup, appGroup}
+)
+
+// UsageGroup summed usage of the rows sharing the grouped fields, the fields
+//  not grouped by are left empty
+type UsageGroup struct {
+	OrganizationGUID  string  `json:"organization_guid,omitempty" csv:"organization_guid"`
+	OrgName           string  `json:"organization_name,omitempty" csv:"organization_name"`
+	SpaceGUID         string  `json:"space_guid,omitempty" csv:"space_guid"`
+	SpaceName         string  `json:"space_name,omitempty" csv:"space_name"`
+	AppGUID           string  `json:"app_guid,omitempty" csv:"app_guid"`
+	AppName           string  `json:"app_name,omitempty" csv:"app_name"`
+	ServiceGUID       string  `json:"service_guid,omitempty" csv:"service_guid"`
+	ServiceName       string  `json:"service_name,omitempty" csv:"service_name"`
+	ServicePlanGUID   string  `json:"service_plan_guid,omitempty" csv:"service_plan_guid"`
+	ServicePlanName   string  `json:"service_plan_name,omitempty" csv:"service_plan_name"`
+	BucketStart       string  `json:"bucket_start,omitempty" csv:"bucket_start" xlsx:"date"`
+	BucketEnd         string  `json:"bucket_end,omitempty" csv:"bucket_end" xlsx:"date"`
+	Rows              int     `json:"rows" csv:"rows"`
+	DurationInSeconds float64 `json:"duration_in_seconds" csv:"duration_in_seconds"`
+	MemoryGBHours     float64 `json:"memory_gb_hours" csv:"memory_gb_hours"`
+	InstanceHours     float64 `json:"instance_hours" csv:"instance_hours"`
+}
+
+// GroupedUsage usage rows summed per group
+type GroupedUsage struct {
+	GroupBy []string        `json:"group_by"`
+	Groups  []UsageGroup    `json:"groups"`
+	Errors  []OrgUsageError `json:"errors,omitempty"`
+}
+
+// ParseGroupBy reads the comma separated group_by fields, checking each is
+//  one the report can group by
+//  /app-usage/thismonth?group_by=org,space
+func ParseGroupBy(c echo.Context, allowed []string) ([]string, error) {
+	param := strings.ToLower(c.QueryParam("group_by"))
+	if param == "" {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, key := range strings.Split(param, ",") {
+		key = strings.TrimSpace(key)
+		found := false
+		for _, a := range allowed {
+			found = found || a == key
+		}
+		if !found {
+			return nil, stacktrace.NewError("group_by must be one or more of %s, not '%s'", strings.Join(allowed, ","), key)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// usageGroups groups kept in the order they were first seen
+type usageGroups struct {
+	keys   []string
+	order  []string
+	groups map[string]*UsageGroup
+}
+
+// add sums a row into its group, row holding every field of the usage row
+func (g *usageGroups) add(row UsageGroup) {
+	grouped := map[string]bool{}
+	for _, key := range g.keys {
+		grouped[key] = true
+	}
+	if !grouped[orgGroup] {
+		row.OrganizationGUID, row.OrgName = "", ""
+	}
+	if !grouped[spaceGroup] {
+		row.SpaceGUID, row.SpaceName = "", ""
+	}
+	if !grouped[appGroup] {
+		row.AppGUID, row.AppName = "", ""
+	}
+	if !grouped[serviceGroup] {
+		row.ServiceGUID, row.ServiceName = "", ""
+	}
+	if !grouped[planGroup] {
+		row.ServicePlanGUID, row.ServicePlanName = "", ""
+	}
+
+	id := strings.Join([]string{row.OrganizationGUID, row.SpaceGUID, row.AppGUID, row.ServiceGUID, row.ServicePlanGUID, row.BucketStart}, "/")
+	if g.groups == nil {
+		g.groups = map[string]*UsageGroup{}
+	}
+	group, found := g.groups[id]
+	if !found {
+		g.order = append(g.order, id)
+		g.groups[id] = &row
+		return
+	}
+	group.Rows += row.Rows
+	group.DurationInSeconds += row.DurationInSeconds
+	group.MemoryGBHours += row.MemoryGBHours
+	group.InstanceHours += row.InstanceHours
+}
+
+// list the groups in the order they were first seen
+func (g *usageGroups) list() []UsageGroup {
+	groups := make([]UsageGroup, 0, len(g.order))
+	for _, id := range g.order {
+		groups = append(groups, *g.groups[id])
+	}
+	return groups
+}
+
+// GroupAppUsage sums the app usage rows per group, keeping buckets apart
+func GroupAppUsage(usageReport *FlattenAppUsage, keys []string) *GroupedUsage {
+	groups := usageGroups{keys: keys}
+	for _, app := range usageReport.Orgs {
+		hours := float64(app.DurationInSeconds) / 3600
+		groups.add(UsageGroup{
+			OrganizationGUID:  app.OrganizationGUID,
+			OrgName:           app.OrgName,
+			SpaceGUID:         app.SpaceGUID,
+			SpaceName:         app.SpaceName,
+			AppGUID:           app.AppGUID,
+			AppName:           app.AppName,
+			BucketStart:       app.BucketStart,
+			BucketEnd:         app.BucketEnd,
+			Rows:              1,
+			DurationInSeconds: float64(app.DurationInSeconds),
+			MemoryGBHours:     float64(app.MemoryInMbPerInstance) / 1024 * float64(app.InstanceCount) * hours,
+			InstanceHours:     float64(app.InstanceCount) * hours,
+		})
+	}
+	return &GroupedUsage{GroupBy: keys, Groups: groups.list(), Errors: usageReport.Errors}
+}
+
+// GroupServiceUsage sums the service usage rows per group, each service
+//  instance counting as a single instance for its duration
+func GroupServiceUsage(usageReport *FlattenServiceUsage, keys []string) *GroupedUsage {
+	groups := usageGroups{keys: keys}
+	for _, service := range usageReport.Orgs {
+		groups.add(UsageGroup{
+			OrganizationGUID:  service.OrganizationGUID,
+			OrgName:           service.OrgName,
+			SpaceGUID:         service.SpaceGUID,
+			SpaceName:         service.SpaceName,
+			ServiceGUID:       service.ServiceGUID,
+			ServiceName:       service.ServiceName,
+			ServicePlanGUID:   service.ServicePlanGUID,
+			ServicePlanName:   service.ServicePlanName,
+			BucketStart:       service.BucketStart,
+			BucketEnd:         service.BucketEnd,
+			Rows:              1,
+			DurationInSeconds: float64(service.DurationInSeconds),
+			InstanceHours:     float64(service.DurationInSeconds) / 3600,
+		})
+	}
+	return &GroupedUsage{GroupBy: keys, Groups: groups.list(), Errors: usageReport.Errors}
+}
+
+// handles grouped report formatting if CSV, NDJSON or XLSX is specified
+func groupReportFormatter(c echo.Context, report *GroupedUsage) error {
+	var format = reportFormat(c)
+	if format == "xlsx" {
+		return xlsxFormatter(c, report.Errors, xlsxSheet{"Groups", report.Groups})
+	}
+	if format != "csv" && format != "ndjson" {
+		return jsonFormatter(c, report)
+	}
+	return newRowStream(c, format, UsageGroup{}).WriteAll(report.Groups, report.Errors)
+}
+
+// GroupTaskUsage sums the task usage rows per group, the app being the
+//  task's parent app and each task run counting as a row
+func GroupTaskUsage(usageReport *FlattenTaskUsage, keys []string) *GroupedUsage {
+	groups := usageGroups{keys: keys}
+	for _, task := range usageReport.Orgs {
+		hours := float64(task.TotalDurationInSecondsForRange) / 3600
+		groups.add(UsageGroup{
+			OrganizationGUID:  task.OrganizationGUID,
+			OrgName:           task.OrgName,
+			SpaceGUID:         task.SpaceGUID,
+			SpaceName:         task.SpaceName,
+			AppGUID:           task.ParentApplicationGUID,
+			AppName:           task.ParentApplicationName,
+			Rows:              task.TaskCountForRange,
+			DurationInSeconds: float64(task.TotalDurationInSecondsForRange),
+			MemoryGBHours:     float64(task.MemoryInMbPerInstance) / 1024 * hours,
+			InstanceHours:     hours,
+		})
+	}
+	return &GroupedUsage{GroupBy: keys, Groups: groups.list(), Errors: usageReport.Errors}
+}
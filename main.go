@@ -1,118 +1,292 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/palantir/stacktrace"
 )
 
 // global variables
-var cfClient *cfclient.Client
 var cfAPI string
-var cfUser string
-var cfPassword string
+var cfUsageAPI string
+var usageTimeout time.Duration
 var cfSkipSsl bool
-var enableBasicAuth bool
+var usageConcurrency = defaultUsageConcurrency
 var dateFormat = "2006-01-02"
 
+// scopes a client needs to read the usage service and every org
+var requiredClientScopes = []string{"usage_service.audit", "cloud_controller.admin_read_only"}
+
 // Main start point for the app
 func main() {
-	// save environment variables
-	cfAPI = os.Getenv("CF_API")
-	cfSkipSsl = os.Getenv("CF_SKIP_SSL_VALIDATION") == "true"
-	cfUser = os.Getenv("CF_ADMIN_USER")
-	cfPassword = os.Getenv("CF_ADMIN_PASSWORD")
-	userBasic := os.Getenv("BASIC_USERNAME")
-	passwordBasic := os.Getenv("BASIC_PASSWORD")
-	enableBasicAuth := os.Getenv("ENABLE_BASIC_AUTH") == "true"
-
-	// make sure no env variable is empty
-	if enableBasicAuth == true {
-		fmt.Print("enableBasicAuth = true")
-		if userBasic == "" || passwordBasic == "" {
-			log.Fatalf("Must set environment variables BASIC_USERNAME and BASIC_PASSWORD")
-		}
-	} else {
-		fmt.Print("enableBasicAuth = false")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: cf-orgs-usage [--config file] [--check-config] [export --help]")
+		flag.PrintDefaults()
+	}
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, report every problem and exit")
+	configFile := flag.String("config", "", "JSON configuration file, defaults to CONFIG_FILE")
+	flag.Parse()
+
+	// an export writes its report to stdout, so everything logged goes to stderr
+	reportOut := os.Stdout
+	if flag.Arg(0) == "export" {
+		os.Stdout = os.Stderr
 	}
-	if cfAPI == "" || os.Getenv("CF_USAGE_API") == "" {
-		log.Fatalf("Must set environment variables CF_API and CF_USAGE_API")
+
+	// read the settings of the bound config service, the environment
+	//  variables filling in the rest
+	if err := LoadServiceSettings(); err != nil {
+		log.Fatalf("Error reading VCAP_SERVICES %v", err)
+	}
+	if *configFile == "" {
+		*configFile = GetSetting("CONFIG_FILE")
 	}
-	if cfUser == "" || cfPassword == "" {
-		log.Fatalf("Must set environment variables CF_ADMIN_USER and CF_ADMIN_PASSWORD")
+	config, problems := LoadConfig(*configFile)
+	if *checkConfig {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
 		return
 	}
+	config.Log()
+	if len(problems) > 0 {
+		log.Fatalf("Invalid configuration:\n%s", strings.Join(problems, "\n"))
+	}
+
+	// save the settings
+	cfAPI = config.CFAPI
+	cfUsageAPI = config.CFUsageAPI
+	cfSkipSsl = config.CFSkipSSLValidation
+	usageTimeout = config.UsageTimeout
+	usageConcurrency = config.UsageConcurrency
+	enableUAAAuth = config.EnableUAAAuth
+	uaaClientIDs = splitClientIDs(config.UAAClientIDs)
+	fiscalYearStart = time.Month(config.FiscalYearStart)
+	setCredentials(config.Credentials())
+	if config.CFCredentialsFile != "" {
+		creds, err := LoadCredentialsFile(config.CFCredentialsFile)
+		if err != nil {
+			log.Fatalf("Error loading credentials %v", err)
+		}
+		setCredentials(creds)
+	}
 
 	// log into PCF when the app starts - if the apptio auditor user changes,
-	//   make sure the restart the app
+	//   update the credentials file or restart the app
 	_, err := SetupCfClient()
 	if err != nil {
 		log.Fatalf("Error setting up client %v", err)
 		return
 	}
+	if config.CFCredentialsFile != "" {
+		go WatchCredentialsFile(config.CFCredentialsFile, config.CFCredentialsInterval)
+	}
+
+	// report on orgs deleted during the period as well
+	includeDeletedOrgs = config.IncludeDeletedOrgs
+
+	// price service usage from the plans' advertised costs
+	enablePlanPricing = config.EnablePlanPricing
+
+	// load the rates used to charge orgs for their usage
+	if config.RateCardFile != "" {
+		rateCard, err = LoadRateCard(config.RateCardFile)
+		if err != nil {
+			log.Fatalf("Error loading rate card %v", err)
+		}
+	}
+
+	// export a single report instead of serving them
+	if flag.Arg(0) == "export" {
+		if err := RunExport(flag.Args()[1:], reportOut); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// keep daily usage on disk and collect the missing days in the background
+	if config.UsageStoreDir != "" {
+		usageStore, err = NewUsageStore(config.UsageStoreDir)
+		if err != nil {
+			log.Fatalf("Error setting up usage store %v", err)
+		}
+		go usageStore.RunCollector(config.UsageStoreDays, config.UsageStoreInterval)
+	}
+
+	// save the scheduled reports as snapshots
+	if config.SnapshotDir != "" {
+		var jobs []SnapshotJob
+		if config.SnapshotScheduleFile != "" {
+			if jobs, err = LoadSnapshotJobs(config.SnapshotScheduleFile); err != nil {
+				log.Fatalf("Error loading snapshot schedule %v", err)
+			}
+		}
+		if snapshots, err = NewSnapshots(config.SnapshotDir, jobs); err != nil {
+			log.Fatalf("Error setting up snapshots %v", err)
+		}
+		go snapshots.Run()
+	}
+
+	// refresh the usage metrics in the background
+	if config.EnableMetrics {
+		metrics = &Metrics{}
+		go metrics.Run(config.MetricsInterval)
+	}
 
 	// create a router
 	e := echo.New()
+	e.Use(Compress())
 
 	// app-usage endpoints
-	e.GET("/app-usage", AppUsageReportByRange)
-	e.GET("/app-usage/today", AppUsageReportForToday)
-	e.GET("/app-usage/yesterday", AppUsageReportForYesterday)
-	e.GET("/app-usage/thismonth", AppUsageReportForMonth)
+	AddPeriodRoutes(e, "/app-usage", appUsageReport)
 
 	// service-usage endpoints
-	e.GET("/service-usage", ServiceUsageReportByRange)
-	e.GET("/service-usage/today", ServiceUsageReportForToday)
-	e.GET("/service-usage/yesterday", ServiceUsageReportForYesterday)
-	e.GET("/service-usage/thismonth", ServiceUsageReportForMonth)
+	AddPeriodRoutes(e, "/service-usage", serviceUsageReport)
+
+	// task-usage endpoints
+	AddPeriodRoutes(e, "/task-usage", taskUsageReport)
+
+	// app, service and task usage workbook endpoints
+	AddPeriodRoutes(e, "/usage-workbook", usageWorkbookReport)
+
+	// application instance endpoints
+	AddPeriodRoutes(e, "/ai-usage", aiUsageReport)
+
+	// org and space drill-down endpoints
+	AddOrgRoutes(e)
+
+	// chargeback endpoints, only when there are rates to charge with
+	if rateCard != nil {
+		AddPeriodRoutes(e, "/chargeback", chargebackReport)
+	}
+
+	// snapshot endpoints
+	if snapshots != nil {
+		e.GET("/snapshots", ListSnapshotsReport)
+		e.GET("/snapshots/:name/:id", GetSnapshot)
+	}
 
-	// task-usage endpoints (need to meet with Pivotal engineers to fix issue)
-	//e.GET("/task-usage/:year/:month", TaskUsageReport)
+	// prometheus metrics endpoint
+	if metrics != nil {
+		e.GET("/metrics", MetricsReport)
+	}
 
-	// confirm basic auth
-	if enableBasicAuth == true {
+	// confirm the caller's UAA token, or basic auth
+	if enableUAAAuth {
+		fmt.Print("Using UAA bearer tokens for user validation")
+		keys, err := NewUAATokenKeys(CfClient())
+		if err != nil {
+			log.Fatalf("Error getting UAA token keys %v", err)
+		}
+		e.Use(UAAAuth(keys, UAAIssuer(CfClient()), uaaClientIDs))
+	} else if config.EnableBasicAuth == true {
 		fmt.Print("Using basic auth for user validation")
 		e.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
-			if username == userBasic && password == passwordBasic {
+			if username == config.BasicUsername && password == config.BasicPassword {
 				return true, nil
 			}
 			return false, nil
 		}))
 	}
-	e.Logger.Fatal(e.Start(":8080"))
+	// StartTLS serves e.TLSServer rather than e.Server
+	for _, server := range []*http.Server{e.Server, e.TLSServer} {
+		server.ReadTimeout = config.ReadTimeout
+		server.WriteTimeout = config.WriteTimeout
+	}
+	if config.TLSCertFile != "" {
+		e.Logger.Fatal(e.StartTLS(config.ListenAddress, config.TLSCertFile, config.TLSKeyFile))
+	}
+	e.Logger.Fatal(e.Start(config.ListenAddress))
 }
 
-// SetupCfClient logs the Apptio Auditor user into PCF
+// SetupCfClient logs the Apptio Auditor user into PCF with the current
+//  credentials and makes it the client used by every report
 func SetupCfClient() (*cfclient.Client, error) {
+	client, err := NewCfClient(getCredentials())
+	if err != nil {
+		return nil, err
+	}
+	currentCfClient.Store(client)
+	return client, nil
+}
+
+// NewCfClient logs the Apptio Auditor user into PCF, or the UAA client
+//  with a client credentials grant when a client id is set
+func NewCfClient(creds CfCredentials) (*cfclient.Client, error) {
 
 	// setup the login data
 	c := &cfclient.Config{
 		ApiAddress:        cfAPI,
-		Username:          cfUser,
-		Password:          cfPassword,
+		Username:          creds.Username,
+		Password:          creds.Password,
 		SkipSslValidation: cfSkipSsl,
 	}
+	if creds.ClientID != "" {
+		c.Username, c.Password = "", ""
+		c.ClientID = creds.ClientID
+		c.ClientSecret = creds.ClientSecret
+	}
 
 	// login
 	client, err := cfclient.NewClient(c)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Error creating cf client")
 	}
-	cfClient = client
+	if creds.ClientID != "" {
+		if err := CheckClientScopes(client, creds.ClientID); err != nil {
+			return nil, err
+		}
+	}
 	return client, nil
 }
 
-// GenTimeParams generates the from and to dates for the app_usages call to apps manager
-func GenTimeParams(year int, month int) string {
-	firstDay := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
-	lastDay := firstDay.AddDate(0, 1, 0).Add(-time.Nanosecond)
-	return "start=" + firstDay.Format(dateFormat) + "&end=" + lastDay.Format(dateFormat)
+// CheckClientScopes gets a token for the client and makes sure it was
+//  granted every scope the reports need
+func CheckClientScopes(client *cfclient.Client, cfClientID string) error {
+	token, err := client.GetToken()
+	if err != nil {
+		return stacktrace.Propagate(err, "Error getting token for client %s, check CF_CLIENT_ID and CF_CLIENT_SECRET", cfClientID)
+	}
+
+	// the token comes straight from UAA, only its claims are needed
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(token, "bearer "), claims); err != nil {
+		return stacktrace.Propagate(err, "Error reading token for client %s", cfClientID)
+	}
+	granted := map[string]bool{}
+	scopes, _ := claims["scope"].([]interface{})
+	for _, scope := range scopes {
+		if s, ok := scope.(string); ok {
+			granted[s] = true
+		}
+	}
+
+	var missing []string
+	for _, scope := range requiredClientScopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return stacktrace.NewError("Client %s is missing the %s scopes, grant them with uaac client update %s --authorities",
+			cfClientID, strings.Join(missing, ", "), cfClientID)
+	}
+	return nil
 }
 
 // GenDateRange generates the from and to dates for the app_usages call to apps manager
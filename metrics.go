@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// content types of the Prometheus text and OpenMetrics exposition formats
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// how often the metrics are refreshed unless METRICS_INTERVAL says otherwise
+const defaultMetricsInterval = 15 * time.Minute
+
+// escapes label values the way both exposition formats expect
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricSample a value of a metric, labels holding name and value pairs
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// metricFamily a gauge or counter and its samples, counters being named
+//  without the _total their samples get
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []metricSample
+}
+
+// metricValues sums the values of a metric by their labels
+type metricValues map[string]*metricSample
+
+// add adds the value to the sample with the labels, name and value pairs
+func (v metricValues) add(value float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+	sample, found := v[key]
+	if !found {
+		sample = &metricSample{labels: labels}
+		v[key] = sample
+	}
+	sample.value += value
+}
+
+// family the samples sorted by their labels so every scrape lists them alike
+func (v metricValues) family(name string, kind string, help string) metricFamily {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	family := metricFamily{name: name, kind: kind, help: help}
+	for _, key := range keys {
+		family.samples = append(family.samples, *v[key])
+	}
+	return family
+}
+
+// Metrics the current usage of the foundation, refreshed in the background
+//  so scrapes never wait on cloud controller or the usage service
+type Metrics struct {
+	mu       sync.RWMutex
+	families []metricFamily
+}
+
+// metrics is nil unless ENABLE_METRICS is true
+var metrics *Metrics
+
+// Run refreshes the metrics now and then again on every interval, with
+//  whichever client is current at the time, keeping the last metrics when
+//  a refresh fails
+func (m *Metrics) Run(interval time.Duration) {
+	for {
+		if err := m.Refresh(context.Background(), CfClient()); err != nil {
+			fmt.Println("error:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Refresh replaces the metrics with the current usage
+func (m *Metrics) Refresh(ctx context.Context, client *cfclient.Client) error {
+	fmt.Println("Refreshing metrics")
+	families, err := GenUsageMetrics(ctx, client, time.Now().Local())
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't refresh metrics")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.families = families
+	return nil
+}
+
+// GenUsageMetrics gauges the running app instances, the memory they reserve
+//  and the service instances of every org and space, and counts the app
+//  instance hours of the month so far from the app usage report
+func GenUsageMetrics(ctx context.Context, client *cfclient.Client, now time.Time) ([]metricFamily, error) {
+	orgs, err := client.ListOrgs()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
+	}
+	spaces, err := client.ListSpaces()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of spaces using client: %v", client)
+	}
+	apps, err := client.ListApps()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of apps using client: %v", client)
+	}
+	serviceInstances, err := client.ListServiceInstances()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of service instances using client: %v", client)
+	}
+	plans, err := client.ListServicePlans()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of service plans using client: %v", client)
+	}
+	services, err := client.ListServices()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of services using client: %v", client)
+	}
+
+	orgNames := map[string]string{}
+	orgInstances, orgMemory, orgHours := metricValues{}, metricValues{}, metricValues{}
+	spaceInstances, spaceMemory, spaceHours := metricValues{}, metricValues{}, metricValues{}
+	for _, org := range orgs {
+		orgNames[org.Guid] = org.Name
+		orgInstances.add(0, "org", org.Name)
+		orgMemory.add(0, "org", org.Name)
+	}
+	spaceByGUID := map[string]cfclient.Space{}
+	for _, space := range spaces {
+		spaceByGUID[space.Guid] = space
+		spaceInstances.add(0, "org", orgNames[space.OrganizationGuid], "space", space.Name)
+		spaceMemory.add(0, "org", orgNames[space.OrganizationGuid], "space", space.Name)
+	}
+
+	// only started apps run instances and reserve memory
+	for _, app := range apps {
+		if app.State != "STARTED" {
+			continue
+		}
+		space := spaceByGUID[app.SpaceGuid]
+		org := orgNames[space.OrganizationGuid]
+		orgInstances.add(float64(app.Instances), "org", org)
+		orgMemory.add(float64(app.Instances*app.Memory), "org", org)
+		spaceInstances.add(float64(app.Instances), "org", org, "space", space.Name)
+		spaceMemory.add(float64(app.Instances*app.Memory), "org", org, "space", space.Name)
+	}
+
+	serviceLabels := map[string]string{}
+	for _, service := range services {
+		serviceLabels[service.Guid] = service.Label
+	}
+	planByGUID := map[string]cfclient.ServicePlan{}
+	for _, plan := range plans {
+		planByGUID[plan.Guid] = plan
+	}
+	orgServices, spaceServices := metricValues{}, metricValues{}
+	for _, instance := range serviceInstances {
+		space := spaceByGUID[instance.SpaceGuid]
+		org := orgNames[space.OrganizationGuid]
+		plan := planByGUID[instance.ServicePlanGuid]
+		service := serviceLabels[plan.ServiceGuid]
+		orgServices.add(1, "org", org, "service", service, "plan", plan.Name)
+		spaceServices.add(1, "org", org, "space", space.Name, "service", service, "plan", plan.Name)
+	}
+
+	// the same usage the app usage report gives for the month so far
+	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	appUsage, err := GenAppUsageReport(ctx, client, firstOfMonth, now, ReportOptions{})
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't get app usage report for metrics")
+	}
+	for _, row := range appUsage.Orgs {
+		hours := float64(row.InstanceCount) * float64(row.DurationInSeconds) / 3600
+		orgHours.add(hours, "org", row.OrgName)
+		spaceHours.add(hours, "org", row.OrgName, "space", row.SpaceName)
+	}
+
+	refreshed := metricValues{}
+	refreshed.add(float64(now.Unix()))
+	return []metricFamily{
+		orgInstances.family("cf_usage_org_app_instances", "gauge", "Running app instances of the org"),
+		spaceInstances.family("cf_usage_space_app_instances", "gauge", "Running app instances of the space"),
+		orgMemory.family("cf_usage_org_app_memory_reserved_mb", "gauge", "Memory in MB reserved by the running app instances of the org"),
+		spaceMemory.family("cf_usage_space_app_memory_reserved_mb", "gauge", "Memory in MB reserved by the running app instances of the space"),
+		orgServices.family("cf_usage_org_service_instances", "gauge", "Service instances of the org by service and plan"),
+		spaceServices.family("cf_usage_space_service_instances", "gauge", "Service instances of the space by service and plan"),
+		orgHours.family("cf_usage_org_app_instance_hours", "counter", "App instance hours of the org since the start of the month"),
+		spaceHours.family("cf_usage_space_app_instance_hours", "counter", "App instance hours of the space since the start of the month"),
+		refreshed.family("cf_usage_metrics_refreshed_timestamp_seconds", "gauge", "When the metrics were last refreshed"),
+	}, nil
+}
+
+// Write writes the metrics in the Prometheus text format, or OpenMetrics,
+//  reporting whether they have been refreshed yet
+func (m *Metrics) Write(w io.Writer, openMetrics bool) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.families == nil {
+		return false
+	}
+
+	for _, family := range m.families {
+		sampleName := family.name
+		if family.kind == "counter" {
+			sampleName += "_total"
+		}
+		familyName := sampleName
+		if openMetrics {
+			familyName = family.name
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", familyName, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", familyName, family.kind)
+		for _, sample := range family.samples {
+			io.WriteString(w, sampleName)
+			if len(sample.labels) > 0 {
+				pairs := make([]string, 0, len(sample.labels)/2)
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					pairs = append(pairs, sample.labels[i]+`="`+labelEscaper.Replace(sample.labels[i+1])+`"`)
+				}
+				io.WriteString(w, "{"+strings.Join(pairs, ",")+"}")
+			}
+			io.WriteString(w, " "+strconv.FormatFloat(sample.value, 'f', -1, 64)+"\n")
+		}
+	}
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+	return true
+}
+
+// MetricsReport returns the current usage for Prometheus to scrape, in the
+//  OpenMetrics format when the scraper asks for it
+//  /metrics
+func MetricsReport(c echo.Context) error {
+	if !GetCaller(c).SeesAll() {
+		return echo.NewHTTPError(http.StatusForbidden, "Metrics cover every org")
+	}
+	openMetrics := strings.Contains(c.Request().Header.Get("Accept"), "application/openmetrics-text")
+	contentType := prometheusContentType
+	if openMetrics {
+		contentType = openMetricsContentType
+	}
+
+	var buf bytes.Buffer
+	if !metrics.Write(&buf, openMetrics) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Metrics haven't been collected yet")
+	}
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
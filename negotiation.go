@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// context key of the dates a report covers, for its file name
+const reportRangeKey = "reportRange"
+
+// acceptFormats the report format of each media type the Accept header can ask for
+var acceptFormats = map[string]string{
+	"application/json":     "json",
+	"text/csv":             "csv",
+	"application/x-ndjson": "ndjson",
+	"application/ndjson":   "ndjson",
+	xlsxContentType:        "xlsx",
+	"*/*":                  "json",
+	"application/*":        "json",
+	"text/*":               "csv",
+}
+
+// formatContentTypes the Content-Type each report format is sent with
+var formatContentTypes = map[string]string{
+	"json":   echo.MIMEApplicationJSONCharsetUTF8,
+	"csv":    "text/csv; charset=UTF-8",
+	"ndjson": "application/x-ndjson",
+	"xlsx":   xlsxContentType,
+	"focus":  "text/csv; charset=UTF-8",
+}
+
+// formatExtensions the file extension of the formats not named after theirs
+var formatExtensions = map[string]string{
+	"focus": "focus.csv",
+}
+
+// characters left out of download file names
+var fileNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// qualityValue an entry of an Accept or Accept-Encoding header
+type qualityValue struct {
+	value string
+	q     float64
+}
+
+// parseQualityList the values of an Accept style header, most wanted first,
+//  leaving out the ones refused with q=0
+func parseQualityList(header string) []qualityValue {
+	var values []qualityValue
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		value := qualityValue{value: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					value.q = q
+				}
+			}
+		}
+		if value.value != "" && value.q > 0 {
+			values = append(values, value)
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].q > values[j].q })
+	return values
+}
+
+// reportFormat the format the caller asked for, json, csv, ndjson or xlsx,
+//  the format parameter taking precedence over the Accept header
+//  /app-usage/thismonth?format=csv or Accept: text/csv
+func reportFormat(c echo.Context) string {
+	if format := strings.ToLower(c.QueryParam("format")); format != "" {
+		return format
+	}
+
+	// the same URL answers differently depending on the Accept header
+	addVary(c, "Accept")
+	for _, accepted := range parseQualityList(c.Request().Header.Get("Accept")) {
+		if format, found := acceptFormats[accepted.value]; found {
+			return format
+		}
+	}
+	return "json"
+}
+
+// addVary adds the request header to the Vary header once
+func addVary(c echo.Context, name string) {
+	header := c.Response().Header()
+	for _, value := range header[echo.HeaderVary] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), name) {
+				return
+			}
+		}
+	}
+	header.Add(echo.HeaderVary, name)
+}
+
+// setReportRange records the dates the report covers for its file name
+func setReportRange(c echo.Context, start time.Time, end time.Time) {
+	c.Set(reportRangeKey, start.Format(dateFormat)+"_"+end.Format(dateFormat))
+}
+
+// reportFileName the name a report is downloaded as, taken from its route
+//  and dates, e.g. app-usage-2018-01-01_2018-01-31 for /app-usage/lastmonth
+//  or team-a-production-app-usage-2018-01-01_2018-01-31 for
+//  /orgs/team-a/spaces/production/app-usage/lastmonth
+func reportFileName(c echo.Context) string {
+	var parts []string
+	for _, segment := range strings.Split(c.Path(), "/") {
+		switch {
+		case segment == "", segment == "orgs", segment == "spaces":
+		case strings.HasPrefix(segment, ":"):
+			parts = append(parts, c.Param(segment[1:]))
+		case isPeriodName(segment):
+		default:
+			parts = append(parts, segment)
+		}
+	}
+	if dates, ok := c.Get(reportRangeKey).(string); ok {
+		parts = append(parts, dates)
+	}
+	name := fileNameUnsafe.ReplaceAllString(strings.Join(parts, "-"), "_")
+	if name == "" {
+		name = "report"
+	}
+	return name
+}
+
+// isPeriodName reports whether the route segment is one of the named periods
+func isPeriodName(segment string) bool {
+	for _, period := range periodNames {
+		if segment == period {
+			return true
+		}
+	}
+	return false
+}
+
+// setContentDisposition names the file the report is saved as, JSON being
+//  shown inline by browsers and the other formats downloaded
+func setContentDisposition(c echo.Context, format string) {
+	disposition := "attachment"
+	if format == "json" {
+		disposition = "inline"
+	}
+	extension, found := formatExtensions[format]
+	if !found {
+		extension = format
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`%s; filename="%s.%s"`, disposition, reportFileName(c), extension))
+}
+
+// jsonFormatter sends the report as JSON
+func jsonFormatter(c echo.Context, report interface{}) error {
+	setContentDisposition(c, "json")
+	return c.JSON(http.StatusOK, report)
+}
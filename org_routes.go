@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// OrgSummary an org that can be drilled down into
+type OrgSummary struct {
+	OrganizationGUID string `json:"organization_guid" csv:"organization_guid"`
+	OrgName          string `json:"organization_name" csv:"organization_name"`
+}
+
+// SpaceSummary a space that can be drilled down into
+type SpaceSummary struct {
+	SpaceGUID string `json:"space_guid" csv:"space_guid"`
+	SpaceName string `json:"space_name" csv:"space_name"`
+}
+
+// orgReport reports on the org of the route, and the space when the route
+//  has one, over the period
+type orgReport func(c echo.Context, org cfclient.Org, start time.Time, end time.Time) error
+
+// orgReports the reports available under /orgs/:org and /orgs/:org/spaces/:space
+var orgReports = map[string]orgReport{
+	"app-usage":     orgAppUsageReport,
+	"service-usage": orgServiceUsageReport,
+	"task-usage":    orgTaskUsageReport,
+}
+
+// AddOrgRoutes registers the org and space drill-down endpoints with the
+//  same periods as the foundation wide ones
+func AddOrgRoutes(e *echo.Echo) {
+	e.GET("/orgs", ListOrgsReport)
+	e.GET("/orgs/:org/spaces", ListSpacesReport)
+	for name, report := range orgReports {
+		for _, prefix := range []string{"/orgs/:org/", "/orgs/:org/spaces/:space/"} {
+			AddPeriodRoutes(e, prefix+name, orgRangeReport(report))
+		}
+	}
+}
+
+// handles summary formatting if CSV or NDJSON is specified
+func summaryReportFormatter(c echo.Context, rows interface{}) error {
+	var format = reportFormat(c)
+	if format != "csv" && format != "ndjson" {
+		return jsonFormatter(c, rows)
+	}
+	return newRowStream(c, format, nil).WriteAll(rows, nil)
+}
+
+// ListOrgsReport lists the orgs of the foundation the caller can see
+//  /orgs
+func ListOrgsReport(c echo.Context) error {
+	orgs, err := CfClient().ListOrgs()
+	if err != nil {
+		return stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", CfClient())
+	}
+	caller := GetCaller(c)
+	summaries := []OrgSummary{}
+	for _, org := range orgs {
+		if !caller.CanSee(org.Guid) {
+			continue
+		}
+		summaries = append(summaries, OrgSummary{OrganizationGUID: org.Guid, OrgName: org.Name})
+	}
+	return summaryReportFormatter(c, summaries)
+}
+
+// ListSpacesReport lists the spaces of the org
+//  /orgs/my-org/spaces
+func ListSpacesReport(c echo.Context) error {
+	org, err := getRouteOrg(c)
+	if err != nil {
+		return err
+	}
+	spaces, err := CfClient().ListSpacesByQuery(url.Values{"q": {"organization_guid:" + org.Guid}})
+	if err != nil {
+		return stacktrace.Propagate(err, "Failed getting list of spaces for org: %s", org.Name)
+	}
+	summaries := []SpaceSummary{}
+	for _, space := range spaces {
+		summaries = append(summaries, SpaceSummary{SpaceGUID: space.Guid, SpaceName: space.Name})
+	}
+	return summaryReportFormatter(c, summaries)
+}
+
+// getRouteOrg looks up the org of the route by name, then by guid, orgs
+//  the caller can't see are not found
+func getRouteOrg(c echo.Context) (cfclient.Org, error) {
+	param := c.Param("org")
+	notFound := echo.NewHTTPError(http.StatusNotFound, "Org '"+param+"' not found")
+	orgs, err := CfClient().ListOrgsByQuery(url.Values{"q": {"name:" + param}})
+	if err != nil {
+		return cfclient.Org{}, stacktrace.Propagate(err, "Failed looking up org: %s", param)
+	}
+	org := cfclient.Org{}
+	if len(orgs) > 0 {
+		org = orgs[0]
+	} else if org, err = CfClient().GetOrgByGuid(param); err != nil {
+		return cfclient.Org{}, notFound
+	}
+	if org.Guid == "" || !GetCaller(c).CanSee(org.Guid) {
+		return cfclient.Org{}, notFound
+	}
+	return org, nil
+}
+
+// getRouteOptions reads the report options, the org of the route taking the
+//  place of the org filter and the space of the route narrowing them down
+//  when it has one
+func getRouteOptions(c echo.Context, org cfclient.Org) (ReportOptions, error) {
+	opts, err := GetReportOptions(c)
+	if err != nil {
+		return opts, err
+	}
+	opts.Filter.Org = &nameFilter{pattern: org.Guid}
+	if space := c.Param("space"); space != "" {
+		opts.Filter.Space = &nameFilter{pattern: space}
+	}
+
+	// the org is already known, so the report needn't list every org
+	opts.Orgs = &ReportOrgs{Orgs: []cfclient.Org{org}}
+	return opts, nil
+}
+
+// orgRangeReport runs the org report for the org of the route
+func orgRangeReport(report orgReport) rangeReport {
+	return func(c echo.Context, start time.Time, end time.Time) error {
+		return runOrgReport(c, report, start, end)
+	}
+}
+
+// runOrgReport looks up the org of the route and runs the report for it
+func runOrgReport(c echo.Context, report orgReport, start time.Time, end time.Time) error {
+	org, err := getRouteOrg(c)
+	if err != nil {
+		return err
+	}
+	return report(c, org, start, end)
+}
+
+// orgAppUsageReport reports on the app usage of the single org
+func orgAppUsageReport(c echo.Context, org cfclient.Org, start time.Time, end time.Time) error {
+	opts, err := getRouteOptions(c, org)
+	if err != nil {
+		return err
+	}
+	return runAppUsageReport(c, start, end, opts)
+}
+
+// orgServiceUsageReport reports on the service usage of the single org,
+//  priced when plan pricing or a rate card is configured
+func orgServiceUsageReport(c echo.Context, org cfclient.Org, start time.Time, end time.Time) error {
+	opts, err := getRouteOptions(c, org)
+	if err != nil {
+		return err
+	}
+	return runServiceUsageReport(c, start, end, opts)
+}
+
+// orgTaskUsageReport reports on the task usage of the single org
+func orgTaskUsageReport(c echo.Context, org cfclient.Org, start time.Time, end time.Time) error {
+	opts, err := getRouteOptions(c, org)
+	if err != nil {
+		return err
+	}
+	return runTaskUsageReport(c, start, end, opts)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+	"github.com/parnurzeal/gorequest"
+)
+
+// default number of orgs queried from the usage service at the same time
+const defaultUsageConcurrency = 8
+
+// ReportOptions optional behavior shared by the app, service and task reports
+type ReportOptions struct {
+	// Partial returns the orgs that succeeded and lists the ones that failed
+	//  instead of failing the whole report
+	Partial bool
+
+	// Granularity splits the range into day, week or month buckets
+	Granularity string
+
+	// Filter narrows the report down to the matching orgs, spaces, apps,
+	//  services and plans
+	Filter UsageFilter
+
+	// Stream, when set, is handed the flattened rows of each org as its
+	//  usage comes back, from the org's worker, instead of them being kept
+	//  in the report
+	Stream func(rows interface{}) error
+
+	// Orgs, when set, are the orgs to report on, listed once for the whole
+	//  range of a report split into buckets rather than for each bucket
+	Orgs *ReportOrgs
+}
+
+// reportOrgs the orgs listed for the whole report, otherwise the orgs of the range
+func (opts ReportOptions) reportOrgs(client *cfclient.Client, start time.Time, end time.Time) (*ReportOrgs, error) {
+	if opts.Orgs != nil {
+		return opts.Orgs, nil
+	}
+	return ListReportOrgs(client, start, end)
+}
+
+// OrgUsageError usage service failure for a single org in a partial report
+type OrgUsageError struct {
+	OrganizationGUID string `json:"organization_guid" csv:"organization_guid"`
+	OrgName          string `json:"organization_name" csv:"organization_name"`
+	StatusCode       int    `json:"status_code" csv:"status_code"`
+	Message          string `json:"message" csv:"message"`
+}
+
+// GetReportOptions reads the report options from the query string
+//  /app-usage/thismonth?partial=true&granularity=day&org=team-*
+func GetReportOptions(c echo.Context) (ReportOptions, error) {
+	filter, err := GetUsageFilter(c)
+	if err != nil {
+		return ReportOptions{}, err
+	}
+	granularity := strings.ToLower(c.QueryParam("granularity"))
+	if reportFormat(c) == focusFormat {
+		if granularity, err = focusGranularity(granularity); err != nil {
+			return ReportOptions{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	return ReportOptions{
+		Partial:     strings.ToLower(c.QueryParam("partial")) == "true",
+		Granularity: granularity,
+		Filter:      filter,
+	}, nil
+}
+
+// newOrgUsageError records why the usage call failed for an org, the HTTP
+//  status is 0 when the usage service could not be reached at all
+func newOrgUsageError(org cfclient.Org, err error) OrgUsageError {
+	status := 0
+	if code := stacktrace.GetCode(err); code != stacktrace.NoCode {
+		status = int(code)
+	}
+	return OrgUsageError{
+		OrganizationGUID: org.Guid,
+		OrgName:          org.Name,
+		StatusCode:       status,
+		Message:          stacktrace.RootCause(err).Error(),
+	}
+}
+
+// collectOrgUsageErrors drops the orgs that did not fail, keeping ListOrgs order
+func collectOrgUsageErrors(failures []*OrgUsageError) []OrgUsageError {
+	var errs []OrgUsageError
+	for _, failure := range failures {
+		if failure != nil {
+			errs = append(errs, *failure)
+		}
+	}
+	return errs
+}
+
+// setOrgUsageErrorsHeader lists the failed orgs in the X-Usage-Errors header
+//  for formats such as CSV that have no room for them in the body
+func setOrgUsageErrorsHeader(c echo.Context, errs []OrgUsageError) {
+	if len(errs) == 0 {
+		return
+	}
+	b, err := json.Marshal(errs)
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	c.Response().Header().Set("X-Usage-Errors", string(b))
+}
+
+// forEachOrg calls fn for every org using at most usageConcurrency workers.
+//  fn receives the index of the org so results can be stored in ListOrgs
+//  order, and the first error cancels the context handed to the others
+func forEachOrg(ctx context.Context, orgs []cfclient.Org, fn func(ctx context.Context, i int, org cfclient.Org) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := usageConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(orgs) {
+		workers = len(orgs)
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	jobs := make(chan int)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(ctx, i, orgs[i]); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	// hand out orgs until they run out or something failed
+feed:
+	for i := range orgs {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		return stacktrace.Propagate(ctx.Err(), "Usage report cancelled")
+	}
+	return firstErr
+}
+
+// getOrgUsage calls one of the apps manager usage endpoints for an org,
+//  e.g. app_usages, and decodes the response into target
+func getOrgUsage(ctx context.Context, token string, org cfclient.Org, endpoint string, dateRange string, target interface{}) error {
+	resp, body, err := requestOrgUsage(ctx, token, org, endpoint, dateRange)
+	if err != nil {
+		return err
+	}
+
+	// the token was revoked, e.g. the credentials changed, log in again and retry once
+	if resp.StatusCode == http.StatusUnauthorized {
+		fmt.Println("Usage service rejected the token, logging in again")
+		if token, err = RefreshCfToken(token); err != nil {
+			return stacktrace.Propagate(err, "Failed getting %s for org %s: %s", endpoint, org.Name, resp.Status)
+		}
+		if resp, body, err = requestOrgUsage(ctx, token, org, endpoint, dateRange); err != nil {
+			return err
+		}
+	}
+
+	if resp.StatusCode != 200 {
+		// keep the upstream resp and message for partial reports
+		upstream := stacktrace.NewErrorWithCode(stacktrace.ErrorCode(resp.StatusCode), "%s", strings.TrimSpace(string(body)))
+		return stacktrace.Propagate(upstream, "Failed getting %s for org %s: %s", endpoint, org.Name, resp.Status)
+	}
+
+	if err := json.Unmarshal(body, target); err != nil {
+		return stacktrace.Propagate(err, "Failed decoding %s for org %s", endpoint, org.Name)
+	}
+	return nil
+}
+
+// requestOrgUsage sends a single usage service request, returning the
+//  response status and body whatever the status
+func requestOrgUsage(ctx context.Context, token string, org cfclient.Org, endpoint string, dateRange string) (*http.Response, []byte, error) {
+	request := gorequest.New().Get(cfUsageAPI+"/organizations/"+org.Guid+"/"+endpoint+"?"+dateRange).
+		Set("Authorization", token).TLSClientConfig(&tls.Config{InsecureSkipVerify: cfSkipSsl})
+
+	// build the request with gorequest but send it ourselves so it can be cancelled
+	req, err := request.MakeRequest()
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "Failed to create %s request for org %s", endpoint, org.Name)
+	}
+	request.Client.Transport = request.Transport
+	request.Client.Timeout = usageTimeout
+	resp, err := request.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "Failed to get %s for org %s", endpoint, org.Name)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "Failed reading %s for org %s", endpoint, org.Name)
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// fiscalYearStart the month the fiscal year, and so its quarters, start in
+var fiscalYearStart = time.January
+
+// periodNames the named periods, each available as a route and as the
+//  period parameter of every report
+var periodNames = []string{
+	"today", "yesterday",
+	"thisweek", "lastweek",
+	"thismonth", "lastmonth",
+	"thisquarter", "lastquarter",
+	"ytd", "thisfiscalyear", "lastfiscalyear",
+}
+
+// PeriodRange the first and last day of the named period relative to now,
+//  weeks starting on Monday and the periods still running ending today
+func PeriodRange(period string, now time.Time) (time.Time, time.Time, error) {
+	currentYear, currentMonth, currentDay := now.Date()
+	location := now.Location()
+	today := time.Date(currentYear, currentMonth, currentDay, 0, 0, 0, 0, location)
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, location)
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	fiscalMonth := (int(currentMonth) - int(fiscalYearStart) + 12) % 12
+	firstOfFiscalYear := firstOfMonth.AddDate(0, -fiscalMonth, 0)
+	firstOfQuarter := firstOfMonth.AddDate(0, -(fiscalMonth % 3), 0)
+
+	switch strings.ToLower(period) {
+	case "today":
+		return now, now, nil
+	case "yesterday":
+		yesterday := now.AddDate(0, 0, -1)
+		return yesterday, yesterday, nil
+	case "thisweek":
+		return monday, now, nil
+	case "lastweek":
+		return monday.AddDate(0, 0, -7), monday.AddDate(0, 0, -1), nil
+	case "thismonth":
+		return firstOfMonth, now, nil
+	case "lastmonth":
+		return firstOfMonth.AddDate(0, -1, 0), firstOfMonth.AddDate(0, 0, -1), nil
+	case "thisquarter":
+		return firstOfQuarter, now, nil
+	case "lastquarter":
+		return firstOfQuarter.AddDate(0, -3, 0), firstOfQuarter.AddDate(0, 0, -1), nil
+	case "ytd":
+		return time.Date(currentYear, time.January, 1, 0, 0, 0, 0, location), now, nil
+	case "thisfiscalyear":
+		return firstOfFiscalYear, now, nil
+	case "lastfiscalyear":
+		return firstOfFiscalYear.AddDate(-1, 0, 0), firstOfFiscalYear.AddDate(0, 0, -1), nil
+	}
+	return now, now, stacktrace.NewError("Period must be one of %s, not '%s'", strings.Join(periodNames, ", "), period)
+}
+
+// GetReportRange reads the dates of the call, from its period or else its
+//  start and end dates
+//  /app-usage?period=lastquarter
+//  /app-usage?start=2017-11-01&end=2017-11-03
+func GetReportRange(c echo.Context) (time.Time, time.Time, error) {
+	if period := c.QueryParam("period"); period != "" {
+		if c.QueryParam("start") != "" || c.QueryParam("end") != "" {
+			return time.Time{}, time.Time{}, echo.NewHTTPError(http.StatusBadRequest, "Use either period or start and end, not both")
+		}
+		start, end, err := PeriodRange(period, time.Now().Local())
+		if err != nil {
+			return start, end, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return start, end, nil
+	}
+
+	fmt.Println("Start date is '" + c.QueryParam("start") + "'")
+	start, err := time.Parse(dateFormat, c.QueryParam("start"))
+	if err != nil {
+		return start, start, stacktrace.Propagate(err, "Improper start date provided in the URL")
+	}
+	end, err := time.Parse(dateFormat, c.QueryParam("end"))
+	if err != nil {
+		return start, end, stacktrace.Propagate(err, "Improper end date provided in the URL")
+	}
+	return start, end, nil
+}
+
+// rangeReport generates a report for the range and formats it
+type rangeReport func(c echo.Context, start time.Time, end time.Time) error
+
+// AddPeriodRoutes registers the report at path, taking a period or a start
+//  and end date, and at path/<period> for every named period
+func AddPeriodRoutes(e *echo.Echo, path string, report rangeReport) {
+	e.GET(path, reportByRange(report))
+	for _, period := range periodNames {
+		e.GET(path+"/"+period, reportForPeriod(report, period))
+	}
+}
+
+// reportByRange handles the period, or the start and end date, in the call
+func reportByRange(report rangeReport) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start, end, err := GetReportRange(c)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Date range is ", GenDateRange(start, end))
+		setReportRange(c, start, end)
+		return report(c, start, end)
+	}
+}
+
+// reportForPeriod handles the route of a named period
+func reportForPeriod(report rangeReport, period string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start, end, err := PeriodRange(period, time.Now().Local())
+		if err != nil {
+			return err
+		}
+		fmt.Println("Date range is ", GenDateRange(start, end))
+		setReportRange(c, start, end)
+		return report(c, start, end)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/palantir/stacktrace"
+)
+
+// where the hourly rate of a service usage row came from
+const (
+	marketplacePriceSource = "marketplace"
+	rateCardPriceSource    = "rate_card"
+)
+
+// hours in each of the cost units brokers publish, a month being the
+//  average 730 hours of a year
+var hoursPerCostUnit = map[string]float64{
+	"HOURLY":  1,
+	"DAILY":   24,
+	"WEEKLY":  168,
+	"MONTHLY": 730,
+	"YEARLY":  8760,
+}
+
+// enablePlanPricing prices service usage from the service plan extra costs
+var enablePlanPricing bool
+
+// PlanPrice price a broker advertises in the service plan extra metadata
+//  "extra": "{\"costs\":[{\"amount\":{\"usd\":99.0},\"unit\":\"MONTHLY\"}]}"
+type PlanPrice struct {
+	Amount   float64
+	Currency string
+	Unit     string
+}
+
+// planExtra the part of the service plan extra metadata holding the costs
+type planExtra struct {
+	Costs []struct {
+		Amount map[string]float64 `json:"amount"`
+		Unit   string             `json:"unit"`
+	} `json:"costs"`
+}
+
+// HourlyRate converts the advertised price to a price per hour
+func (p PlanPrice) HourlyRate() float64 {
+	return p.Amount / hoursPerCostUnit[strings.ToUpper(p.Unit)]
+}
+
+// parsePlanPrice reads the first cost priced per period of time, rather than
+//  e.g. per GB, from the plan extra metadata cloud controller returns as a
+//  string; with a currency only a price in that currency counts, so costs
+//  are never added up across currencies, otherwise usd is preferred
+func parsePlanPrice(extra interface{}, currency string) (PlanPrice, bool) {
+	var b []byte
+	switch value := extra.(type) {
+	case nil:
+		return PlanPrice{}, false
+	case string:
+		b = []byte(value)
+	default:
+		b, _ = json.Marshal(value)
+	}
+
+	var metadata planExtra
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return PlanPrice{}, false
+	}
+
+	for _, cost := range metadata.Costs {
+		if _, found := hoursPerCostUnit[strings.ToUpper(cost.Unit)]; !found || len(cost.Amount) == 0 {
+			continue
+		}
+
+		// brokers write currency codes in either case
+		currencies := make([]string, 0, len(cost.Amount))
+		for c := range cost.Amount {
+			currencies = append(currencies, c)
+		}
+		sort.Strings(currencies)
+		chosen := ""
+		if currency != "" {
+			for _, c := range currencies {
+				if strings.EqualFold(c, currency) {
+					chosen = c
+				}
+			}
+		} else {
+			chosen = currencies[0]
+			for _, c := range currencies {
+				if strings.EqualFold(c, "usd") {
+					chosen = c
+				}
+			}
+		}
+		if chosen == "" {
+			continue
+		}
+		return PlanPrice{Amount: cost.Amount[chosen], Currency: strings.ToUpper(chosen), Unit: cost.Unit}, true
+	}
+	return PlanPrice{}, false
+}
+
+// GetPlanPrices lists the service plans and the prices they advertise, keyed by plan guid
+func GetPlanPrices(client *cfclient.Client, currency string) (map[string]PlanPrice, error) {
+	plans, err := client.ListServicePlans()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of service plans using client: %v", client)
+	}
+
+	prices := map[string]PlanPrice{}
+	for _, plan := range plans {
+		if price, found := parsePlanPrice(plan.Extra, currency); found {
+			prices[plan.Guid] = price
+		}
+	}
+	return prices, nil
+}
+
+// ServicePricer looks the marketplace prices up once, returning a func that
+//  prices service usage rows with them, e.g. as they are streamed
+func ServicePricer(client *cfclient.Client) (func(rows []FlattenOrgServiceUsage), error) {
+	currency := ""
+	if rateCard != nil {
+		currency = rateCard.Currency
+	}
+
+	prices := map[string]PlanPrice{}
+	if enablePlanPricing {
+		var err error
+		prices, err = GetPlanPrices(client, currency)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Couldn't get service plan prices")
+		}
+	}
+	return func(rows []FlattenOrgServiceUsage) {
+		priceServiceRows(rows, prices)
+	}, nil
+}
+
+// priceServiceRows prices each row from the marketplace prices, falling
+//  back to the rate card
+func priceServiceRows(rows []FlattenOrgServiceUsage, prices map[string]PlanPrice) {
+	for i := range rows {
+		row := &rows[i]
+		hours := float64(row.DurationInSeconds) / 3600
+
+		if price, found := prices[row.ServicePlanGUID]; found {
+			row.PlanPrice = price.Amount
+			row.PlanPriceUnit = price.Unit
+			row.PlanCurrency = price.Currency
+			row.HourlyRate = price.HourlyRate()
+			row.PriceSource = marketplacePriceSource
+		} else if rateCard != nil {
+			row.PlanCurrency = rateCard.Currency
+			row.HourlyRate = rateCard.ServicePlanRate(row.ServiceName, row.ServicePlanName)
+			row.PriceSource = rateCardPriceSource
+		} else {
+			continue
+		}
+		row.Cost = hours * row.HourlyRate
+	}
+}
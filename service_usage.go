@@ -1,18 +1,14 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"strings"
 	"time"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
-	"github.com/jszwec/csvutil"
 	"github.com/labstack/echo"
 	"github.com/palantir/stacktrace"
-	"github.com/parnurzeal/gorequest"
 )
 
 // ServiceUsage array of orgs usage
@@ -24,6 +20,7 @@ type ServiceUsage struct {
 type OrgServiceUsage struct {
 	OrganizationGUID string    `json:"organization_guid" csv:"organization_guid"`
 	OrgName          string    `json:"organization_name" csv:"organization_name"`
+	OrgDeleted       bool      `json:"org_deleted" csv:"org_deleted"`
 	PeriodStart      time.Time `json:"period_start" csv:"period_start"`
 	PeriodEnd        time.Time `json:"period_end" csv:"period_end"`
 	ServiceUsages    []struct {
@@ -45,15 +42,19 @@ type OrgServiceUsage struct {
 
 // FlattenServiceUsage flattened data for simple response with repeated org info
 type FlattenServiceUsage struct {
-	Orgs []FlattenOrgServiceUsage `json:"service_usages" csv:"service_usages"`
+	Orgs   []FlattenOrgServiceUsage `json:"service_usages" csv:"service_usages"`
+	Errors []OrgUsageError          `json:"errors,omitempty" csv:"-"`
 }
 
 // FlattenOrgServiceUsage flattened data for simple response usage
 type FlattenOrgServiceUsage struct {
 	OrganizationGUID        string    `json:"organization_guid" csv:"organization_guid"`
 	OrgName                 string    `json:"organization_name" csv:"organization_name"`
+	OrgDeleted              bool      `json:"org_deleted" csv:"org_deleted"`
 	PeriodStart             time.Time `json:"period_start" csv:"period_start"`
 	PeriodEnd               time.Time `json:"period_end" csv:"period_end"`
+	BucketStart             string    `json:"bucket_start,omitempty" csv:"bucket_start" xlsx:"date"`
+	BucketEnd               string    `json:"bucket_end,omitempty" csv:"bucket_end" xlsx:"date"`
 	Deleted                 bool      `json:"deleted" csv:"deleted"`
 	DurationInSeconds       float32   `json:"duration_in_seconds" csv:"duration_in_seconds"`
 	SpaceGUID               string    `json:"space_guid" csv:"space_guid"`
@@ -67,164 +68,225 @@ type FlattenOrgServiceUsage struct {
 	ServiceGUID             string    `json:"service_guid" csv:"service_guid"`
 	ServiceInstanceCreation time.Time `json:"service_instance_creation" csv:"service_instance_creation"`
 	ServiceInstanceDeletion time.Time `json:"service_instance_deletion" csv:"service_instance_deletion"`
+	PlanPrice               float64   `json:"plan_price,omitempty" csv:"plan_price"`
+	PlanPriceUnit           string    `json:"plan_price_unit,omitempty" csv:"plan_price_unit"`
+	PlanCurrency            string    `json:"plan_currency,omitempty" csv:"plan_currency"`
+	PriceSource             string    `json:"price_source,omitempty" csv:"price_source"`
+	HourlyRate              float64   `json:"hourly_rate,omitempty" csv:"hourly_rate"`
+	Cost                    float64   `json:"cost" csv:"cost"`
 }
 
-// handles report formatting if CSV is specified
+// handles report formatting if CSV, NDJSON, XLSX or FOCUS is specified, summing
+//  the rows per group when group_by is
 func serviceReportFormatter(c echo.Context, usageReport *FlattenServiceUsage) error {
-	var format = strings.ToLower(c.QueryParam("format"))
-	if format == "csv" {
-		fmt.Println("csv output requested")
-		b, err := csvutil.Marshal(usageReport.Orgs)
-		if err != nil {
-			fmt.Println("error:", err)
+	groupBy, err := ParseGroupBy(c, serviceGroupKeys)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	var format = reportFormat(c)
+	if format == focusFormat {
+		if len(groupBy) > 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "group_by can't be used with format=focus")
 		}
-		return c.String(http.StatusOK, string(b))
-	} else {
-		return c.JSON(http.StatusOK, usageReport)
+		return focusFormatter(c, FocusServiceUsage(usageReport.Orgs), usageReport.Errors)
+	}
+	if len(groupBy) > 0 {
+		return groupReportFormatter(c, GroupServiceUsage(usageReport, groupBy))
 	}
-}
-
-// ServiceUsageReportByRange handle a start and end date in the call
-//  /service-usage?start=2017-11-01&end=2017-11-03
-func ServiceUsageReportByRange(c echo.Context) error {
 
-	// format the date range
-	fmt.Println("Start date is '" + c.QueryParam("start") + "'")
-	start, err := time.Parse(dateFormat, c.QueryParam("start"))
-	if err != nil {
-		return stacktrace.Propagate(err, "Improper start date provided in the URL")
+	if format == "xlsx" {
+		return xlsxFormatter(c, usageReport.Errors, serviceUsageSheets(usageReport)...)
 	}
-	end, err := time.Parse(dateFormat, c.QueryParam("end"))
-	if err != nil {
-		return stacktrace.Propagate(err, "Improper end date provided in the URL")
+	if format == "csv" || format == "ndjson" {
+		return newRowStream(c, format, FlattenOrgServiceUsage{}).WriteAll(usageReport.Orgs, usageReport.Errors)
+	} else {
+		return jsonFormatter(c, usageReport)
 	}
+}
 
-	// format the start and end string
-	dateRange := GenDateRange(start, end)
-	fmt.Println("Date range is ", dateRange)
-
-	// Generate the report for all orgs
-	flatUsage, err := GetServiceUsageReport(cfClient, dateRange)
+// serviceUsageReport generates the service usage report for all orgs over the range
+//  /service-usage?start=2017-11-01&end=2017-11-03, /service-usage/yesterday
+func serviceUsageReport(c echo.Context, start time.Time, end time.Time) error {
+	opts, err := GetReportOptions(c)
 	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't service service usage report for yesterday")
+		return err
 	}
-
-	// return report
-	return serviceReportFormatter(c, flatUsage)
+	return runServiceUsageReport(c, start, end, opts)
 }
 
-// ServiceUsageReportForToday handles the static nature of Apptio's Datalink
-//  in order to gather service usage data for the previous day
-func ServiceUsageReportForToday(c echo.Context) error {
-	// format the date range
-	dateToday := time.Now().Local()
-
-	// format the start and end string
-	dateRange := GenDateRange(dateToday, dateToday)
-	fmt.Println("Date range is ", dateRange)
+// runServiceUsageReport generates the service usage report with the options, streaming the rows
+//  or formatting the whole report
+func runServiceUsageReport(c echo.Context, start time.Time, end time.Time, opts ReportOptions) error {
+	// stream the rows as each org's usage comes back
+	if format := streamFormat(c); format != "" {
+		stream := newRowStream(c, format, FlattenOrgServiceUsage{})
+		opts.Stream = stream.Write
+		flatUsage, err := serviceUsageForRange(c.Request().Context(), start, end, opts)
+		if err != nil {
+			return stream.Fail(stacktrace.Propagate(err, "Couldn't get service usage report for range"))
+		}
+		return stream.Close(flatUsage.Errors)
+	}
 
-	// Generate the report for all orgs
-	flatUsage, err := GetServiceUsageReport(cfClient, dateRange)
+	flatUsage, err := serviceUsageForRange(c.Request().Context(), start, end, opts)
 	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get service usage report for yesterday")
+		return stacktrace.Propagate(err, "Couldn't get service usage report for range")
 	}
 
 	// return report
 	return serviceReportFormatter(c, flatUsage)
 }
 
-// ServiceUsageReportForYesterday handles the static nature of Apptio's Datalink
-//  in order to gather service usage data for the previous day
-func ServiceUsageReportForYesterday(c echo.Context) error {
-	// format the date range
-	dateToday := time.Now().Local()
-	dateYesterday := dateToday.AddDate(0, 0, -1)
-
-	// format the start and end string
-	dateRange := GenDateRange(dateYesterday, dateYesterday)
-	fmt.Println("Date range is ", dateRange)
+// serviceUsageForRange reports on the range as a whole, or bucket by bucket
+//  tagging each row with its bucket when a granularity is requested, and
+//  prices it when plan pricing or a rate card is configured
+func serviceUsageForRange(ctx context.Context, start time.Time, end time.Time, opts ReportOptions) (*FlattenServiceUsage, error) {
+	var err error
+	buckets := []DateBucket{{Start: start, End: end}}
+	if opts.Granularity != "" {
+		buckets, err = SplitDateRange(start, end, opts.Granularity)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
 
-	// Generate the report for all orgs
-	flatUsage, err := GetServiceUsageReport(cfClient, dateRange)
-	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get service usage report for yesterday")
+		// list the orgs once for the whole range rather than for each bucket
+		if opts.Orgs == nil {
+			if opts.Orgs, err = ListReportOrgs(CfClient(), start, end); err != nil {
+				return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", CfClient())
+			}
+		}
 	}
 
-	// return report
-	return serviceReportFormatter(c, flatUsage)
-}
-
-// ServiceUsageReportForMonth handles the service-usage call validating the date
-//  and executing the report creation
-func ServiceUsageReportForMonth(c echo.Context) error {
-
-	// first day of month and today's date
-	dateToday := time.Now().Local()
-	currentYear, currentMonth, _ := dateToday.Date()
-	currentLocation := dateToday.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	// look the prices up once, streamed rows being priced as they go by
+	price := func(rows []FlattenOrgServiceUsage) {}
+	if enablePlanPricing || rateCard != nil {
+		if price, err = ServicePricer(CfClient()); err != nil {
+			return nil, stacktrace.Propagate(err, "Couldn't price service usage report")
+		}
+	}
 
-	// format the start and end string
-	dateRange := GenDateRange(firstOfMonth, dateToday)
-	fmt.Println("Date range is ", dateRange)
+	usageReport := &FlattenServiceUsage{}
+	for _, bucket := range buckets {
+		bucketStart, bucketEnd := bucket.Start.Format(dateFormat), bucket.End.Format(dateFormat)
+		prepare := func(rows []FlattenOrgServiceUsage) {
+			for i := range rows {
+				if opts.Granularity != "" {
+					rows[i].BucketStart, rows[i].BucketEnd = bucketStart, bucketEnd
+				}
+			}
+			price(rows)
+		}
+		bucketOpts := opts
+		if opts.Stream != nil {
+			bucketOpts.Stream = func(rows interface{}) error {
+				prepare(rows.([]FlattenOrgServiceUsage))
+				return opts.Stream(rows)
+			}
+		}
 
-	// Generate the report for all orgs
-	flatUsage, err := GetServiceUsageReport(cfClient, dateRange)
-	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get service usage report for yesterday")
+		bucketReport, err := serviceUsageForPeriod(ctx, bucket.Start, bucket.End, bucketOpts)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Couldn't get service usage for %s", GenDateRange(bucket.Start, bucket.End))
+		}
+		prepare(bucketReport.Orgs)
+		usageReport.Orgs = append(usageReport.Orgs, bucketReport.Orgs...)
+		usageReport.Errors = append(usageReport.Errors, bucketReport.Errors...)
 	}
+	return usageReport, nil
+}
 
-	// return report
-	return serviceReportFormatter(c, flatUsage)
+// serviceUsageForPeriod serves the report from the usage store when every day
+//  in the period has been collected, otherwise from the usage service
+func serviceUsageForPeriod(ctx context.Context, start time.Time, end time.Time, opts ReportOptions) (*FlattenServiceUsage, error) {
+	if usageStore != nil && usageStore.Covers(serviceUsageKind, start, end) {
+		fmt.Println("Serving service usage from the usage store")
+		usageReport, err := usageStore.ServiceUsage(start, end)
+		if err != nil {
+			return nil, err
+		}
+		opts.Filter.FilterServiceUsage(usageReport)
+		if opts.Stream != nil {
+			if err := opts.Stream(usageReport.Orgs); err != nil {
+				return nil, err
+			}
+			usageReport.Orgs = nil
+		}
+		return usageReport, nil
+	}
+	return GetServiceUsageReport(ctx, CfClient(), start, end, opts)
 }
 
 // GetServiceUsageReport pulls the entire report together
-func GetServiceUsageReport(client *cfclient.Client, dateRange string) (*FlattenServiceUsage, error) {
+func GetServiceUsageReport(ctx context.Context, client *cfclient.Client, start time.Time, end time.Time, opts ReportOptions) (*FlattenServiceUsage, error) {
 
-	// get a list of orgs within the foundation
-	orgs, err := client.ListOrgs()
+	// get a list of orgs within the foundation, including the deleted ones
+	//  that still have usage in the period
+	reportOrgs, err := opts.reportOrgs(client, start, end)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
 	}
+	orgs := opts.Filter.FilterOrgs(reportOrgs.Orgs)
+	deletedOrgs := reportOrgs.Deleted
+	dateRange := GenDateRange(start, end)
 
-	report := ServiceUsage{}
+	report := ServiceUsage{Orgs: make([]OrgServiceUsage, len(orgs))}
 	token, err := client.GetToken()
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Failed getting token using client: %v", client)
 	}
 
-	// loop through orgs and get service usage report for each
-	for _, org := range orgs {
-		orgUsage, err := GetServiceUsageForOrg(token, org, dateRange)
+	// get service usage report for each org, keeping the orgs in order
+	failures := make([]*OrgUsageError, len(orgs))
+	err = forEachOrg(ctx, orgs, func(ctx context.Context, i int, org cfclient.Org) error {
+		orgUsage, err := GetServiceUsageForOrg(ctx, token, org, dateRange)
+		if err != nil && opts.Partial {
+			failure := newOrgUsageError(org, err)
+			failures[i] = &failure
+			return nil
+		}
 		if err != nil {
-			return nil, stacktrace.Propagate(err, "Failed getting service usage for org: "+org.Name)
+			return stacktrace.Propagate(err, "Failed getting service usage for org: %s", org.Name)
 		}
 		orgUsage.OrgName = org.Name
-		report.Orgs = append(report.Orgs, *orgUsage)
+		orgUsage.OrgDeleted = deletedOrgs[org.Guid]
+		if opts.Stream != nil {
+			return streamServiceUsage(orgUsage, opts)
+		}
+		report.Orgs[i] = *orgUsage
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	flatServiceReport, err := GetFlattenedServiceOutput(&report)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Couldn't get service usage report")
 	}
+	flatServiceReport.Errors = collectOrgUsageErrors(failures)
+	opts.Filter.FilterServiceUsage(&flatServiceReport)
 
 	return &flatServiceReport, nil
 }
 
-// GetServiceUsageForOrg queries apps manager service_usages API for the orgs service usage information
-func GetServiceUsageForOrg(token string, org cfclient.Org, dateRange string) (*OrgServiceUsage, error) {
-	usageAPI := os.Getenv("CF_USAGE_API")
-	target := &OrgServiceUsage{}
-	request := gorequest.New()
-	resp, _, err := request.Get(usageAPI+"/organizations/"+org.Guid+"/service_usages?"+dateRange).
-		Set("Authorization", token).TLSClientConfig(&tls.Config{InsecureSkipVerify: cfSkipSsl}).
-		EndStruct(&target)
+// streamServiceUsage flattens, filters and streams the service usage of a single org
+func streamServiceUsage(orgUsage *OrgServiceUsage, opts ReportOptions) error {
+	flatReport, err := GetFlattenedServiceOutput(&ServiceUsage{Orgs: []OrgServiceUsage{*orgUsage}})
 	if err != nil {
-		return nil, stacktrace.Propagate(err[0], "Failed to get service usage report %v", org)
+		return stacktrace.Propagate(err, "Couldn't flatten service usage for org %s", orgUsage.OrgName)
+	}
+	opts.Filter.FilterServiceUsage(&flatReport)
+	if len(flatReport.Orgs) == 0 {
+		return nil
 	}
+	return opts.Stream(flatReport.Orgs)
+}
 
-	if resp.StatusCode != 200 {
-		return nil, stacktrace.NewError("Failed getting service usage report %v", resp)
+// GetServiceUsageForOrg queries apps manager service_usages API for the orgs service usage information
+func GetServiceUsageForOrg(ctx context.Context, token string, org cfclient.Org, dateRange string) (*OrgServiceUsage, error) {
+	target := &OrgServiceUsage{}
+	if err := getOrgUsage(ctx, token, org, "service_usages", dateRange, target); err != nil {
+		return nil, stacktrace.Propagate(err, "Failed to get service usage report for org %s", org.Name)
 	}
 	return target, nil
 }
@@ -239,6 +301,7 @@ func GetFlattenedServiceOutput(usageReport *ServiceUsage) (FlattenServiceUsage,
 			serviceusage := FlattenOrgServiceUsage{
 				OrganizationGUID:        orgs.OrganizationGUID,
 				OrgName:                 orgs.OrgName,
+				OrgDeleted:              orgs.OrgDeleted,
 				PeriodStart:             orgs.PeriodStart,
 				PeriodEnd:               orgs.PeriodEnd,
 				Deleted:                 service.Deleted,
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// default name or tag of the service binding holding the settings
+const defaultConfigServiceName = "cf-orgs-usage-config"
+
+// serviceSettings the credentials of the bound config service, by setting name
+var serviceSettings = map[string]string{}
+
+// serviceSettingsSource name of the service the settings came from
+var serviceSettingsSource string
+
+// vcapService a service binding in VCAP_SERVICES, CredHub references are
+//  already resolved into the credentials by the time the app starts
+type vcapService struct {
+	Name        string                 `json:"name"`
+	Tags        []string               `json:"tags"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// LoadServiceSettings reads the settings from the user-provided or CredHub
+//  service bound with the CONFIG_SERVICE_NAME name or tag, if there is one
+func LoadServiceSettings() error {
+	vcap := os.Getenv("VCAP_SERVICES")
+	if vcap == "" {
+		return nil
+	}
+	serviceName := os.Getenv("CONFIG_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultConfigServiceName
+	}
+
+	// keep numbers as written, 1000000 rather than 1e+06
+	var services map[string][]vcapService
+	decoder := json.NewDecoder(strings.NewReader(vcap))
+	decoder.UseNumber()
+	if err := decoder.Decode(&services); err != nil {
+		return stacktrace.Propagate(err, "Couldn't parse VCAP_SERVICES")
+	}
+	for _, bindings := range services {
+		for _, binding := range bindings {
+			if !binding.hasNameOrTag(serviceName) {
+				continue
+			}
+			for key, value := range binding.Credentials {
+				serviceSettings[strings.ToUpper(key)] = fmt.Sprint(value)
+			}
+			serviceSettingsSource = binding.Name
+			return nil
+		}
+	}
+	return nil
+}
+
+// hasNameOrTag reports whether the binding is called or tagged name
+func (s vcapService) hasNameOrTag(name string) bool {
+	if s.Name == name {
+		return true
+	}
+	for _, tag := range s.Tags {
+		if tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSetting reads a setting from the bound config service, falling back
+//  to the environment variable of the same name
+func GetSetting(name string) string {
+	if value, found := serviceSettings[name]; found {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// settingSource describes where a setting set outside the config file came from
+func settingSource(name string) string {
+	if _, found := serviceSettings[name]; found {
+		return "service " + serviceSettingsSource
+	}
+	return "environment"
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// how often and how long after a failure a snapshot is tried again
+const (
+	snapshotRetries    = 3
+	snapshotRetryDelay = 10 * time.Minute
+)
+
+// format of the time a snapshot was taken in its file name
+const snapshotTimeFormat = "20060102T150405"
+
+// snapshot names are directory names, so kept to letters, digits and dashes
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// SnapshotJob a report saved on a cron schedule, read from SNAPSHOT_SCHEDULE_FILE
+//  [{"name": "app-yesterday", "cron": "0 2 * * *", "type": "app", "period": "yesterday", "format": "csv"}]
+type SnapshotJob struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	Type     string `json:"type"`
+	Period   string `json:"period"`
+	Format   string `json:"format"`
+	schedule *CronSchedule
+}
+
+// Snapshot a saved report, its id being its file name
+type Snapshot struct {
+	Name        string `json:"name" csv:"name"`
+	ID          string `json:"id" csv:"id"`
+	Type        string `json:"type" csv:"type"`
+	PeriodStart string `json:"period_start" csv:"period_start" xlsx:"date"`
+	PeriodEnd   string `json:"period_end" csv:"period_end" xlsx:"date"`
+	Format      string `json:"format" csv:"format"`
+	CreatedAt   string `json:"created_at" csv:"created_at"`
+	Size        int64  `json:"size" csv:"size"`
+}
+
+// Snapshots runs the snapshot jobs and keeps every report they save under dir
+type Snapshots struct {
+	dir  string
+	jobs []SnapshotJob
+}
+
+// snapshots is nil unless SNAPSHOT_DIR is set
+var snapshots *Snapshots
+
+// LoadSnapshotJobs reads and checks the snapshot schedule
+func LoadSnapshotJobs(path string) ([]SnapshotJob, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't read snapshot schedule %s", path)
+	}
+	var jobs []SnapshotJob
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't parse snapshot schedule %s", path)
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		if !snapshotNamePattern.MatchString(job.Name) {
+			return nil, stacktrace.NewError("Snapshot name '%s' must be letters, digits and dashes", job.Name)
+		}
+		if job.schedule, err = ParseCron(job.Cron); err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid schedule for snapshot %s", job.Name)
+		}
+		if job.Type != "app" && job.Type != "service" && job.Type != "task" {
+			return nil, stacktrace.NewError("Snapshot %s type must be app, service or task", job.Name)
+		}
+		if job.Format == "" {
+			job.Format = "json"
+		}
+		if job.Format != "json" && job.Format != "csv" && job.Format != "xlsx" {
+			return nil, stacktrace.NewError("Snapshot %s format must be json, csv or xlsx", job.Name)
+		}
+		if _, _, err := PeriodRange(job.Period, time.Now()); err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid period for snapshot %s", job.Name)
+		}
+	}
+	return jobs, nil
+}
+
+// NewSnapshots creates the snapshot directory
+func NewSnapshots(dir string, jobs []SnapshotJob) (*Snapshots, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't create snapshot directory %s", dir)
+	}
+	return &Snapshots{dir: dir, jobs: jobs}, nil
+}
+
+// Run starts every job whose schedule matches, once a minute
+func (s *Snapshots) Run() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+		for _, job := range s.jobs {
+			if job.schedule.Matches(next) {
+				go s.take(job, next)
+			}
+		}
+	}
+}
+
+// take generates and saves the job's report, trying again a few times so
+//  a failing usage service doesn't lose the day
+func (s *Snapshots) take(job SnapshotJob, at time.Time) {
+	start, end, _ := PeriodRange(job.Period, at)
+	for attempt := 0; ; attempt++ {
+		fmt.Println("Taking snapshot", job.Name, "for", GenDateRange(start, end))
+		b, _, err := GenReportFile(context.Background(), job.Type, start, end, job.Format, ReportOptions{})
+		if err == nil {
+			err = s.save(job, at, start, end, b)
+		}
+		if err == nil {
+			return
+		}
+		fmt.Println("error:", err)
+		if attempt == snapshotRetries {
+			fmt.Println("Giving up on snapshot", job.Name, "for", GenDateRange(start, end))
+			return
+		}
+		time.Sleep(snapshotRetryDelay)
+	}
+}
+
+// save writes the report as a new version, never replacing an earlier one
+func (s *Snapshots) save(job SnapshotJob, at time.Time, start time.Time, end time.Time, b []byte) error {
+	dir := filepath.Join(s.dir, job.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return stacktrace.Propagate(err, "Couldn't create snapshot directory %s", dir)
+	}
+	id := strings.Join([]string{at.Format(snapshotTimeFormat), job.Type, start.Format(dateFormat), end.Format(dateFormat)}, "_") + "." + job.Format
+	target := filepath.Join(dir, id)
+	if err := ioutil.WriteFile(target+".tmp", b, 0644); err != nil {
+		return stacktrace.Propagate(err, "Couldn't write %s", target)
+	}
+	if err := os.Rename(target+".tmp", target); err != nil {
+		return stacktrace.Propagate(err, "Couldn't write %s", target)
+	}
+	fmt.Println("Saved snapshot", target)
+	return nil
+}
+
+// List the saved snapshots, newest first, of every job or just the named one
+func (s *Snapshots) List(name string) ([]Snapshot, error) {
+	pattern := filepath.Join(s.dir, "*", "*")
+	if name != "" {
+		pattern = filepath.Join(s.dir, name, "*")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't list snapshots")
+	}
+
+	list := []Snapshot{}
+	for _, file := range files {
+		snapshot, ok := parseSnapshotFile(file)
+		if !ok {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			snapshot.Size = info.Size()
+		}
+		list = append(list, snapshot)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+	return list, nil
+}
+
+// parseSnapshotFile reads a snapshot's details back from its path
+//  <dir>/<name>/<created>_<type>_<start>_<end>.<format>
+func parseSnapshotFile(file string) (Snapshot, bool) {
+	id := filepath.Base(file)
+	ext := filepath.Ext(id)
+	parts := strings.Split(strings.TrimSuffix(id, ext), "_")
+	if len(parts) != 4 || (ext != ".json" && ext != ".csv" && ext != ".xlsx") {
+		return Snapshot{}, false
+	}
+	created, err := time.ParseInLocation(snapshotTimeFormat, parts[0], time.Local)
+	if err != nil {
+		return Snapshot{}, false
+	}
+	return Snapshot{
+		Name:        filepath.Base(filepath.Dir(file)),
+		ID:          id,
+		Type:        parts[1],
+		PeriodStart: parts[2],
+		PeriodEnd:   parts[3],
+		Format:      strings.TrimPrefix(ext, "."),
+		CreatedAt:   created.Format(time.RFC3339),
+	}, true
+}
+
+// snapshots cover the whole foundation, so callers limited to their own
+//  orgs can't see them
+func checkSnapshotAccess(c echo.Context) error {
+	if !GetCaller(c).SeesAll() {
+		return echo.NewHTTPError(http.StatusForbidden, "Snapshots cover every org")
+	}
+	return nil
+}
+
+// ListSnapshotsReport lists the saved snapshots
+//  /snapshots?name=app-yesterday
+func ListSnapshotsReport(c echo.Context) error {
+	if err := checkSnapshotAccess(c); err != nil {
+		return err
+	}
+	name := c.QueryParam("name")
+	if name != "" && !snapshotNamePattern.MatchString(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid snapshot name")
+	}
+	list, err := snapshots.List(name)
+	if err != nil {
+		return err
+	}
+	return summaryReportFormatter(c, list)
+}
+
+// GetSnapshot downloads a saved snapshot
+//  /snapshots/app-yesterday/20180702T020000_app_2018-07-01_2018-07-01.csv
+func GetSnapshot(c echo.Context) error {
+	if err := checkSnapshotAccess(c); err != nil {
+		return err
+	}
+	name, id := c.Param("name"), c.Param("id")
+	if !snapshotNamePattern.MatchString(name) || id != filepath.Base(id) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid snapshot")
+	}
+	file := filepath.Join(snapshots.dir, name, id)
+	if _, ok := parseSnapshotFile(file); !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Snapshot not found")
+	}
+	if _, err := os.Stat(file); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Snapshot not found")
+	}
+	return c.Attachment(file, id)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/jszwec/csvutil"
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// trailers sent after a streamed report, since its headers are long gone
+//  by the time the orgs that failed are known
+const (
+	usageErrorsTrailer = "X-Usage-Errors"
+	usageErrorTrailer  = "X-Usage-Error"
+)
+
+// streamFormat the format the report rows are streamed in, ndjson or csv,
+//  or empty when the report has to be built first, e.g. to group it
+func streamFormat(c echo.Context) string {
+	format := reportFormat(c)
+	if (format != "ndjson" && format != "csv") || c.QueryParam("group_by") != "" {
+		return ""
+	}
+	return format
+}
+
+// rowStream writes report rows to the response as each org's usage comes
+//  back, one JSON object per line or one CSV record per row, flushing after
+//  every org so the response goes out with chunked transfer encoding
+type rowStream struct {
+	mu      sync.Mutex
+	c       echo.Context
+	format  string
+	row     interface{}
+	csvw    *csv.Writer
+	csv     *csvutil.Encoder
+	json    *json.Encoder
+	started bool
+	written int
+
+	// built when the whole report was ready before writing, the failed orgs
+	//  then going in the X-Usage-Errors header rather than a trailer
+	built bool
+}
+
+// newRowStream streams rows like row, whose type gives the CSV header of
+//  a report with no rows, nil taking it from the rows written
+func newRowStream(c echo.Context, format string, row interface{}) *rowStream {
+	return &rowStream{c: c, format: format, row: row}
+}
+
+// start sends the headers, announcing the trailers
+func (s *rowStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	fmt.Println(s.format, "output requested")
+
+	resp := s.c.Response()
+	resp.Header().Set(echo.HeaderContentType, formatContentTypes[s.format])
+	setContentDisposition(s.c, s.format)
+	if s.format == "ndjson" {
+		s.json = json.NewEncoder(resp)
+	} else {
+		s.csvw = csv.NewWriter(resp)
+		s.csv = csvutil.NewEncoder(s.csvw)
+	}
+	if !s.built {
+		resp.Header().Set("Trailer", usageErrorsTrailer+", "+usageErrorTrailer)
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// Write sends a slice of rows, safe to call from every org's worker
+func (s *rowStream) Write(rows interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start()
+
+	v := reflect.ValueOf(rows)
+	if s.row == nil {
+		s.row = reflect.Zero(v.Type().Elem()).Interface()
+	}
+	for i := 0; i < v.Len(); i++ {
+		var err error
+		if s.json != nil {
+			err = s.json.Encode(v.Index(i).Interface())
+		} else {
+			err = s.csv.Encode(v.Index(i).Interface())
+		}
+		if err != nil {
+			return stacktrace.Propagate(err, "Couldn't stream report row")
+		}
+		s.written++
+	}
+	return s.flush()
+}
+
+// flush pushes what has been written so far out to the caller
+func (s *rowStream) flush() error {
+	if s.csvw != nil {
+		s.csvw.Flush()
+		if err := s.csvw.Error(); err != nil {
+			return stacktrace.Propagate(err, "Couldn't stream report row")
+		}
+	}
+	s.c.Response().Flush()
+	return nil
+}
+
+// Close ends the report, listing the orgs that failed in the X-Usage-Errors
+//  trailer, and writing the CSV header when there were no rows at all
+func (s *rowStream) Close(errs []OrgUsageError) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start()
+
+	if s.csv != nil && s.written == 0 {
+		if err := s.csv.EncodeHeader(s.row); err != nil {
+			fmt.Println("error:", err)
+		}
+	}
+	if len(errs) > 0 {
+		b, err := json.Marshal(errs)
+		if err != nil {
+			fmt.Println("error:", err)
+		} else {
+			s.c.Response().Header().Set(usageErrorsTrailer, string(b))
+		}
+	}
+	return s.flush()
+}
+
+// Fail ends the report with an error, which is returned as usual when
+//  nothing was sent yet and otherwise only fits in the X-Usage-Error trailer
+func (s *rowStream) Fail(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return err
+	}
+	fmt.Println("error:", err)
+	s.c.Response().Header().Set(usageErrorTrailer, stacktrace.RootCause(err).Error())
+	s.flush()
+	return nil
+}
+
+// WriteAll sends a report that has already been built, without holding
+//  a second copy of it in memory the way csvutil.Marshal does
+func (s *rowStream) WriteAll(rows interface{}, errs []OrgUsageError) error {
+	s.built = true
+	setOrgUsageErrorsHeader(s.c, errs)
+	if err := s.Write(rows); err != nil {
+		return err
+	}
+	return s.Close(nil)
+}
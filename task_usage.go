@@ -1,114 +1,259 @@
 package main
 
 import (
-	"crypto/tls"
-	"fmt"
+	"context"
 	"net/http"
-	"os"
-	"strconv"
+	"sort"
 	"time"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/labstack/echo"
 	"github.com/palantir/stacktrace"
-	"github.com/parnurzeal/gorequest"
 )
 
 // TaskUsage array of orgs usage
 type TaskUsage struct {
-	Orgs []OrgTaskUsage `json:"orgs"`
+	Orgs []OrgTaskUsage `json:"orgs" csv:"orgs"`
 }
 
-// OrgTaskUsage Single org usage
-//   Spaces           map[string]{struct, interface} {
+// OrgTaskUsage Single org usage, spaces are keyed by space guid
 type OrgTaskUsage struct {
-	OrganizationGUID string    `json:"organization_guid"`
-	OrgName          string    `json:"organization_name"`
-	PeriodStart      time.Time `json:"period_start"`
-	PeriodEnd        time.Time `json:"period_end"`
-	Spaces           []struct {
-		SpaceGUID []struct {
-			SpaceName     string `json:"space_name"`
-			TaskSummaries []struct {
-				ParentApplicationGUID              string `json:"parent_application_guid"`
-				ParentApplicationName              string `json:"parent_application_name"`
-				MemoryInMbPerInstance              int    `json:"memory_in_mb_per_instance"`
-				TaskCountForRange                  int    `json:"task_count_for_range"`
-				TotalDurationInSecondsForRange     int    `json:"total_duration_in_seconds_for_range"`
-				MaxConcurrentTaskCountForParentApp int    `json:"max_concurrent_task_count_for_parent_app"`
-			} `json:"task_summaries"`
-		} `json:"space_guid"`
-	} `json:"spaces"`
+	OrganizationGUID string                    `json:"organization_guid" csv:"organization_guid"`
+	OrgName          string                    `json:"organization_name" csv:"organization_name"`
+	OrgDeleted       bool                      `json:"org_deleted" csv:"org_deleted"`
+	PeriodStart      string                    `json:"period_start" csv:"period_start"`
+	PeriodEnd        string                    `json:"period_end" csv:"period_end"`
+	Spaces           map[string]SpaceTaskUsage `json:"spaces" csv:"spaces"`
 }
 
-// TaskUsageReport handles the app-usage call validating the date
-//  and executing the report creation
-func TaskUsageReport(c echo.Context) error {
-	year, err := strconv.Atoi(c.Param("year"))
+// SpaceTaskUsage task summaries for a single space
+type SpaceTaskUsage struct {
+	SpaceName     string `json:"space_name" csv:"space_name"`
+	TaskSummaries []struct {
+		ParentApplicationGUID              string `json:"parent_application_guid" csv:"parent_application_guid"`
+		ParentApplicationName              string `json:"parent_application_name" csv:"parent_application_name"`
+		MemoryInMbPerInstance              int    `json:"memory_in_mb_per_instance" csv:"memory_in_mb_per_instance"`
+		TaskCountForRange                  int    `json:"task_count_for_range" csv:"task_count_for_range"`
+		TotalDurationInSecondsForRange     int    `json:"total_duration_in_seconds_for_range" csv:"total_duration_in_seconds_for_range"`
+		MaxConcurrentTaskCountForParentApp int    `json:"max_concurrent_task_count_for_parent_app" csv:"max_concurrent_task_count_for_parent_app"`
+	} `json:"task_summaries" csv:"task_summaries"`
+}
+
+// FlattenTaskUsage flattened data for simple response with repeated org info
+type FlattenTaskUsage struct {
+	Orgs   []FlattenOrgTaskUsage `json:"task_usages" csv:"task_usages"`
+	Errors []OrgUsageError       `json:"errors,omitempty" csv:"-"`
+}
+
+// FlattenOrgTaskUsage flattened data for simple response usage
+type FlattenOrgTaskUsage struct {
+	OrganizationGUID                   string    `json:"organization_guid" csv:"organization_guid"`
+	OrgName                            string    `json:"organization_name" csv:"organization_name"`
+	OrgDeleted                         bool      `json:"org_deleted" csv:"org_deleted"`
+	PeriodStart                        time.Time `json:"period_start" csv:"period_start"`
+	PeriodEnd                          time.Time `json:"period_end" csv:"period_end"`
+	SpaceGUID                          string    `json:"space_guid" csv:"space_guid"`
+	SpaceName                          string    `json:"space_name" csv:"space_name"`
+	ParentApplicationGUID              string    `json:"parent_application_guid" csv:"parent_application_guid"`
+	ParentApplicationName              string    `json:"parent_application_name" csv:"parent_application_name"`
+	MemoryInMbPerInstance              int       `json:"memory_in_mb_per_instance" csv:"memory_in_mb_per_instance"`
+	TaskCountForRange                  int       `json:"task_count_for_range" csv:"task_count_for_range"`
+	TotalDurationInSecondsForRange     int       `json:"total_duration_in_seconds_for_range" csv:"total_duration_in_seconds_for_range"`
+	MaxConcurrentTaskCountForParentApp int       `json:"max_concurrent_task_count_for_parent_app" csv:"max_concurrent_task_count_for_parent_app"`
+}
+
+// handles report formatting if CSV, NDJSON or XLSX is specified, summing
+//  the rows per group when group_by is
+func taskReportFormatter(c echo.Context, usageReport *FlattenTaskUsage) error {
+	groupBy, err := ParseGroupBy(c, taskGroupKeys)
 	if err != nil {
-		return stacktrace.Propagate(err, "couldn't convert year to number")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	month, err := strconv.Atoi(c.Param("month"))
+	if len(groupBy) > 0 {
+		return groupReportFormatter(c, GroupTaskUsage(usageReport, groupBy))
+	}
+
+	var format = reportFormat(c)
+	if format == "xlsx" {
+		return xlsxFormatter(c, usageReport.Errors, taskUsageSheets(usageReport)...)
+	}
+	if format == "csv" || format == "ndjson" {
+		return newRowStream(c, format, FlattenOrgTaskUsage{}).WriteAll(usageReport.Orgs, usageReport.Errors)
+	} else {
+		return jsonFormatter(c, usageReport)
+	}
+}
+
+// taskUsageReport generates the task usage report for all orgs over the range
+//  /task-usage?start=2017-11-01&end=2017-11-03, /task-usage/yesterday
+func taskUsageReport(c echo.Context, start time.Time, end time.Time) error {
+	opts, err := GetReportOptions(c)
 	if err != nil {
-		return stacktrace.Propagate(err, "couldn't convert month to number")
+		return err
+	}
+	return runTaskUsageReport(c, start, end, opts)
+}
+
+// runTaskUsageReport generates the task usage report with the options, streaming the rows
+//  or formatting the whole report
+func runTaskUsageReport(c echo.Context, start time.Time, end time.Time, opts ReportOptions) error {
+	// tasks aren't charged, so there is nothing to write as FOCUS
+	if reportFormat(c) == focusFormat {
+		return echo.NewHTTPError(http.StatusBadRequest, "format=focus isn't available for task usage")
 	}
 
-	usageReport, err := GetTaskUsageReport(cfClient, year, month)
+	// stream the rows as each org's usage comes back
+	if format := streamFormat(c); format != "" {
+		stream := newRowStream(c, format, FlattenOrgTaskUsage{})
+		opts.Stream = stream.Write
+		usageReport, err := GetTaskUsageReport(c.Request().Context(), CfClient(), start, end, opts)
+		if err != nil {
+			return stream.Fail(stacktrace.Propagate(err, "Couldn't get task usage report for range"))
+		}
+		return stream.Close(usageReport.Errors)
+	}
 
+	// Generate the report for all orgs
+	usageReport, err := GetTaskUsageReport(c.Request().Context(), CfClient(), start, end, opts)
 	if err != nil {
-		return stacktrace.Propagate(err, "Couldn't get task usage report")
+		return stacktrace.Propagate(err, "Couldn't get task usage report for range")
 	}
-	return c.JSON(http.StatusOK, usageReport)
+
+	// return report
+	return taskReportFormatter(c, usageReport)
 }
 
 // GetTaskUsageReport pulls the entire report together
-func GetTaskUsageReport(client *cfclient.Client, year int, month int) (*TaskUsage, error) {
-	if !(month >= 1 && month <= 12) {
-		return nil, stacktrace.NewError("Month must be between 1-12")
-	}
+func GetTaskUsageReport(ctx context.Context, client *cfclient.Client, start time.Time, end time.Time, opts ReportOptions) (*FlattenTaskUsage, error) {
 
-	// get a list of orgs within the foundation
-	orgs, err := client.ListOrgs()
+	// get a list of orgs within the foundation, including the deleted ones
+	//  that still have usage in the period
+	reportOrgs, err := opts.reportOrgs(client, start, end)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
 	}
+	orgs := opts.Filter.FilterOrgs(reportOrgs.Orgs)
+	deletedOrgs := reportOrgs.Deleted
+	dateRange := GenDateRange(start, end)
 
-	report := TaskUsage{}
+	report := TaskUsage{Orgs: make([]OrgTaskUsage, len(orgs))}
 	token, err := client.GetToken()
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Failed getting token using client: %v", client)
 	}
 
-	// loop through orgs and get app usage report for each
-	for _, org := range orgs {
-		orgUsage, err := GetTaskUsageForOrg(token, org, year, month)
+	// get task usage report for each org, keeping the orgs in order
+	failures := make([]*OrgUsageError, len(orgs))
+	err = forEachOrg(ctx, orgs, func(ctx context.Context, i int, org cfclient.Org) error {
+		orgUsage, err := GetTaskUsageForOrg(ctx, token, org, dateRange)
+		if err != nil && opts.Partial {
+			failure := newOrgUsageError(org, err)
+			failures[i] = &failure
+			return nil
+		}
 		if err != nil {
-			return nil, stacktrace.Propagate(err, "Failed getting task usage for org: "+org.Name)
+			return stacktrace.Propagate(err, "Failed getting task usage for org: %s", org.Name)
 		}
 		orgUsage.OrgName = org.Name
-		report.Orgs = append(report.Orgs, *orgUsage)
+		orgUsage.OrgDeleted = deletedOrgs[org.Guid]
+		if opts.Stream != nil {
+			return streamTaskUsage(orgUsage, opts)
+		}
+		report.Orgs[i] = *orgUsage
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return &report, nil
+	// flatten the complexity of report for ease of consumption
+	flatReport, err := GetFlattenedTaskOutput(&report)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't get task usage report")
+	}
+	flatReport.Errors = collectOrgUsageErrors(failures)
+	opts.Filter.FilterTaskUsage(&flatReport)
+
+	return &flatReport, nil
+}
+
+// streamTaskUsage flattens, filters and streams the task usage of a single org
+func streamTaskUsage(orgUsage *OrgTaskUsage, opts ReportOptions) error {
+	flatReport, err := GetFlattenedTaskOutput(&TaskUsage{Orgs: []OrgTaskUsage{*orgUsage}})
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't flatten task usage for org %s", orgUsage.OrgName)
+	}
+	opts.Filter.FilterTaskUsage(&flatReport)
+	if len(flatReport.Orgs) == 0 {
+		return nil
+	}
+	return opts.Stream(flatReport.Orgs)
 }
 
-// GetTaskUsageForOrg queries apps manager app_usages API for the orgs app usage information
-func GetTaskUsageForOrg(token string, org cfclient.Org, year int, month int) (*OrgTaskUsage, error) {
-	usageAPI := os.Getenv("CF_USAGE_API")
+// GetTaskUsageForOrg queries apps manager task_usages API for the orgs task usage information
+func GetTaskUsageForOrg(ctx context.Context, token string, org cfclient.Org, dateRange string) (*OrgTaskUsage, error) {
 	target := &OrgTaskUsage{}
-	request := gorequest.New()
+	if err := getOrgUsage(ctx, token, org, "task_usages", dateRange, target); err != nil {
+		return nil, stacktrace.Propagate(err, "Failed to get task usage report for org %s", org.Name)
+	}
+	return target, nil
+}
 
-	fmt.Println(usageAPI + "/organizations/" + org.Guid + "/task_usages?" + GenTimeParams(year, month))
+// GetFlattenedTaskOutput convert formatting to flattened output
+func GetFlattenedTaskOutput(usageReport *TaskUsage) (FlattenTaskUsage, error) {
 
-	resp, _, err := request.Get(usageAPI+"/organizations/"+org.Guid+"/task_usages?"+GenTimeParams(year, month)).
-		Set("Authorization", token).TLSClientConfig(&tls.Config{InsecureSkipVerify: cfSkipSsl}).
-		EndStruct(&target)
-	if err != nil {
-		return nil, stacktrace.Propagate(err[0], "Failed to get task usage report %v", org)
+	var flatUsage FlattenTaskUsage
+
+	for _, orgs := range usageReport.Orgs {
+		// task_usages returns plain dates, unlike the app and service endpoints
+		periodStart, err := parseUsageDate(orgs.PeriodStart)
+		if err != nil {
+			return flatUsage, stacktrace.Propagate(err, "Improper period_start for org: %s", orgs.OrgName)
+		}
+		periodEnd, err := parseUsageDate(orgs.PeriodEnd)
+		if err != nil {
+			return flatUsage, stacktrace.Propagate(err, "Improper period_end for org: %s", orgs.OrgName)
+		}
+
+		// spaces come back as a map, so sort the guids for a stable report
+		spaceGUIDs := make([]string, 0, len(orgs.Spaces))
+		for spaceGUID := range orgs.Spaces {
+			spaceGUIDs = append(spaceGUIDs, spaceGUID)
+		}
+		sort.Strings(spaceGUIDs)
+
+		for _, spaceGUID := range spaceGUIDs {
+			space := orgs.Spaces[spaceGUID]
+			for _, task := range space.TaskSummaries {
+				taskusage := FlattenOrgTaskUsage{
+					OrganizationGUID:                   orgs.OrganizationGUID,
+					OrgName:                            orgs.OrgName,
+					OrgDeleted:                         orgs.OrgDeleted,
+					PeriodStart:                        periodStart,
+					PeriodEnd:                          periodEnd,
+					SpaceGUID:                          spaceGUID,
+					SpaceName:                          space.SpaceName,
+					ParentApplicationGUID:              task.ParentApplicationGUID,
+					ParentApplicationName:              task.ParentApplicationName,
+					MemoryInMbPerInstance:              task.MemoryInMbPerInstance,
+					TaskCountForRange:                  task.TaskCountForRange,
+					TotalDurationInSecondsForRange:     task.TotalDurationInSecondsForRange,
+					MaxConcurrentTaskCountForParentApp: task.MaxConcurrentTaskCountForParentApp,
+				}
+				flatUsage.Orgs = append(flatUsage.Orgs, taskusage)
+			}
+		}
 	}
+	return flatUsage, nil
+}
 
-	if resp.StatusCode != 200 {
-		return nil, stacktrace.NewError("Failed getting task usage report %v", resp)
+// parseUsageDate accepts either a plain date or a full timestamp
+func parseUsageDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
 	}
-	return target, nil
+	if t, err := time.Parse(dateFormat, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
 }
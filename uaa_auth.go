@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+	"github.com/parnurzeal/gorequest"
+)
+
+// echo context key the authenticated caller is kept under
+const callerKey = "caller"
+
+// how long the orgs a caller can see are cached, and how often the token
+//  keys may be fetched again when a token is signed with an unknown key
+const (
+	callerOrgsTTL       = 5 * time.Minute
+	tokenKeysMinRefresh = time.Minute
+)
+
+// adminScopes let a caller see every org
+var adminScopes = []string{
+	"cloud_controller.admin",
+	"cloud_controller.admin_read_only",
+	"cloud_controller.global_auditor",
+}
+
+// clients whose tokens are accepted unless UAA_CLIENT_IDS says otherwise,
+//  the cf CLI issuing the tokens of cf oauth-token
+const defaultUAAClientIDs = "cf"
+
+// enableUAAAuth authenticates callers with their own UAA bearer token
+var enableUAAAuth bool
+
+// uaaClientIDs the UAA clients whose tokens callers may use
+var uaaClientIDs []string
+
+// Caller the user a request was made by, when authenticating with UAA
+type Caller struct {
+	UserID   string
+	UserName string
+	Admin    bool
+
+	// Orgs the caller is OrgManager, OrgAuditor or BillingManager of,
+	//  nil for admins who see every org
+	Orgs map[string]bool
+}
+
+// SeesAll reports whether the caller may see every org, as anyone can
+//  without UAA auth
+func (c *Caller) SeesAll() bool {
+	return c == nil || c.Orgs == nil
+}
+
+// CanSee reports whether the caller may see the org
+func (c *Caller) CanSee(orgGUID string) bool {
+	return c.SeesAll() || c.Orgs[orgGUID]
+}
+
+// GetCaller the authenticated caller of the request, nil without UAA auth
+func GetCaller(c echo.Context) *Caller {
+	caller, _ := c.Get(callerKey).(*Caller)
+	return caller
+}
+
+// UAATokenKeys the public keys UAA signs tokens with, keyed by key id
+type UAATokenKeys struct {
+	url     string
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// NewUAATokenKeys fetches the token keys of the UAA the client logs in with
+func NewUAATokenKeys(client *cfclient.Client) (*UAATokenKeys, error) {
+	keys := &UAATokenKeys{url: strings.TrimSuffix(client.Endpoint.TokenEndpoint, "/") + "/token_keys"}
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	if err := keys.fetch(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// fetch replaces the keys with the ones UAA currently publishes
+func (k *UAATokenKeys) fetch() error {
+	resp, body, errs := gorequest.New().Get(k.url).
+		TLSClientConfig(&tls.Config{InsecureSkipVerify: cfSkipSsl}).EndBytes()
+	if len(errs) > 0 {
+		return stacktrace.Propagate(errs[0], "Failed getting UAA token keys from %s", k.url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return stacktrace.NewError("Failed getting UAA token keys from %s: %s", k.url, resp.Status)
+	}
+
+	var published struct {
+		Keys []struct {
+			Kid   string `json:"kid"`
+			Value string `json:"value"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &published); err != nil {
+		return stacktrace.Propagate(err, "Failed decoding UAA token keys")
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, published := range published.Keys {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(published.Value))
+		if err != nil {
+			return stacktrace.Propagate(err, "Failed parsing UAA token key %s", published.Kid)
+		}
+		keys[published.Kid] = key
+	}
+	k.keys = keys
+	k.fetched = time.Now()
+	return nil
+}
+
+// key returns the key with the id, fetching the keys again when UAA has
+//  rotated to a key we don't know yet
+func (k *UAATokenKeys) key(kid string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, found := k.keys[kid]; found {
+		return key, nil
+	}
+	if time.Since(k.fetched) > tokenKeysMinRefresh {
+		if err := k.fetch(); err != nil {
+			return nil, err
+		}
+		if key, found := k.keys[kid]; found {
+			return key, nil
+		}
+	}
+	return nil, stacktrace.NewError("Unknown UAA token key '%s'", kid)
+}
+
+// UAAIssuer the issuer of the tokens of the UAA the client logs in with
+func UAAIssuer(client *cfclient.Client) string {
+	return strings.TrimSuffix(client.Endpoint.TokenEndpoint, "/") + "/oauth/token"
+}
+
+// splitClientIDs the comma separated client ids, without blanks
+func splitClientIDs(value string) []string {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkTokenClaims checks the token was issued by our UAA, and to one of
+//  the clients, by its client_id or its audience, so tokens issued to other
+//  clients can't be replayed against the service
+func checkTokenClaims(claims jwt.MapClaims, issuer string, clientIDs []string) error {
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return stacktrace.NewError("Token issuer '%s' isn't %s", iss, issuer)
+	}
+
+	var audience []string
+	if clientID, ok := claims["client_id"].(string); ok {
+		audience = append(audience, clientID)
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = append(audience, aud)
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	for _, a := range audience {
+		for _, id := range clientIDs {
+			if a == id {
+				return nil
+			}
+		}
+	}
+	return stacktrace.NewError("Token was issued for %v, not %s", audience, strings.Join(clientIDs, ", "))
+}
+
+// callerOrgs caches the orgs each user can see for callerOrgsTTL
+type callerOrgs struct {
+	mu    sync.Mutex
+	users map[string]cachedOrgs
+}
+
+// cachedOrgs the orgs a user could see when they were looked up
+type cachedOrgs struct {
+	orgs    map[string]bool
+	fetched time.Time
+}
+
+// visibleOrgs caches the orgs of every caller
+var visibleOrgs = &callerOrgs{users: map[string]cachedOrgs{}}
+
+// get the orgs the user is OrgManager, OrgAuditor or BillingManager of
+func (v *callerOrgs) get(ctx context.Context, client *cfclient.Client, userID string) (map[string]bool, error) {
+	v.mu.Lock()
+	cached, found := v.users[userID]
+	v.mu.Unlock()
+	if found && time.Since(cached.fetched) < callerOrgsTTL {
+		return cached.orgs, nil
+	}
+
+	orgs, err := client.ListOrgs()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting list of orgs using client: %v", client)
+	}
+
+	// check the roles of each org, several orgs at a time
+	visible := make([]bool, len(orgs))
+	err = forEachOrg(ctx, orgs, func(ctx context.Context, i int, org cfclient.Org) error {
+		for _, list := range []func(string) ([]cfclient.User, error){
+			client.ListOrgManagers,
+			client.ListOrgAuditors,
+			client.ListOrgBillingManagers,
+		} {
+			users, err := list(org.Guid)
+			if err != nil {
+				return stacktrace.Propagate(err, "Failed getting roles of org: %s", org.Name)
+			}
+			for _, user := range users {
+				if user.Guid == userID {
+					visible[i] = true
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orgGUIDs := map[string]bool{}
+	for i, org := range orgs {
+		if visible[i] {
+			orgGUIDs[org.Guid] = true
+		}
+	}
+	v.mu.Lock()
+	v.users[userID] = cachedOrgs{orgs: orgGUIDs, fetched: time.Now()}
+	v.mu.Unlock()
+	return orgGUIDs, nil
+}
+
+// UAAAuth authenticates callers with a UAA bearer token signed by one of
+//  the token keys, issued by the issuer to one of the clients, and limits
+//  non admin callers to the orgs they have a role in
+func UAAAuth(keys *UAATokenKeys, issuer string, clientIDs []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			if !strings.HasPrefix(strings.ToLower(auth), "bearer ") {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Missing bearer token")
+			}
+
+			claims := jwt.MapClaims{}
+			_, err := jwt.ParseWithClaims(strings.TrimSpace(auth[len("bearer "):]), claims, func(token *jwt.Token) (interface{}, error) {
+				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+					return nil, stacktrace.NewError("Unexpected signing method %v", token.Header["alg"])
+				}
+				kid, _ := token.Header["kid"].(string)
+				return keys.key(kid)
+			})
+			if err == nil {
+				err = checkTokenClaims(claims, issuer, clientIDs)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid bearer token")
+			}
+
+			caller := &Caller{}
+			caller.UserID, _ = claims["user_id"].(string)
+			caller.UserName, _ = claims["user_name"].(string)
+			scopes, _ := claims["scope"].([]interface{})
+			for _, scope := range scopes {
+				for _, admin := range adminScopes {
+					caller.Admin = caller.Admin || scope == admin
+				}
+			}
+
+			if !caller.Admin {
+				if caller.UserID == "" {
+					return echo.NewHTTPError(http.StatusForbidden, "Token has no user and no admin scope")
+				}
+				caller.Orgs, err = visibleOrgs.get(c.Request().Context(), CfClient(), caller.UserID)
+				if err != nil {
+					return stacktrace.Propagate(err, "Couldn't get the orgs of user %s", caller.UserName)
+				}
+			}
+			c.Set(callerKey, caller)
+			return next(c)
+		}
+	}
+}
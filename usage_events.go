@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/palantir/stacktrace"
+)
+
+// how long usage events are kept in full, older ones are only kept as the
+//  last event of their app or service instance, which holds its state
+const usageEventRetention = 92 * 24 * time.Hour
+
+// UsageEventLog the cloud controller app and service usage events, paged in
+//  full once and from then on only after the last event already seen, so
+//  reports don't download the whole event history every time
+type UsageEventLog struct {
+	mu            sync.Mutex
+	appEvents     []cfclient.AppUsageEvent
+	serviceEvents []cfclient.ServiceUsageEvent
+}
+
+// usageEvents the events shared by every report
+var usageEvents = &UsageEventLog{}
+
+// usageEventsQuery the query paging the events after the guid, or all of
+//  them when there is none yet
+func usageEventsQuery(afterGUID string) url.Values {
+	query := url.Values{"results-per-page": {"100"}}
+	if afterGUID != "" {
+		query.Set("after_guid", afterGUID)
+	}
+	return query
+}
+
+// AppEvents the app usage events, oldest first, with the new ones paged in;
+//  the events returned must not be changed
+func (l *UsageEventLog) AppEvents(client *cfclient.Client) ([]cfclient.AppUsageEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	afterGUID := ""
+	if n := len(l.appEvents); n > 0 {
+		afterGUID = l.appEvents[n-1].GUID
+	}
+	events, err := client.ListAppUsageEventsByQuery(usageEventsQuery(afterGUID))
+	if err != nil && afterGUID != "" {
+		// cloud controller purged the last event seen, start over
+		fmt.Println("Reloading app usage events:", err)
+		l.appEvents = nil
+		events, err = client.ListAppUsageEventsByQuery(usageEventsQuery(""))
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting app usage events using client: %v", client)
+	}
+
+	all := append(l.appEvents, events...)
+	kept := retainedUsageEvents(len(all), time.Now(), func(i int) (string, string) { return all[i].CreatedAt, all[i].AppGUID })
+	if kept != nil {
+		l.appEvents = make([]cfclient.AppUsageEvent, 0, len(kept))
+		for _, i := range kept {
+			l.appEvents = append(l.appEvents, all[i])
+		}
+	} else {
+		l.appEvents = all
+	}
+	return l.appEvents, nil
+}
+
+// ServiceEvents the service usage events, oldest first, with the new ones
+//  paged in; the events returned must not be changed
+func (l *UsageEventLog) ServiceEvents(client *cfclient.Client) ([]cfclient.ServiceUsageEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	afterGUID := ""
+	if n := len(l.serviceEvents); n > 0 {
+		afterGUID = l.serviceEvents[n-1].GUID
+	}
+	events, err := client.ListServiceUsageEventsByQuery(usageEventsQuery(afterGUID))
+	if err != nil && afterGUID != "" {
+		// cloud controller purged the last event seen, start over
+		fmt.Println("Reloading service usage events:", err)
+		l.serviceEvents = nil
+		events, err = client.ListServiceUsageEventsByQuery(usageEventsQuery(""))
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Failed getting service usage events using client: %v", client)
+	}
+
+	all := append(l.serviceEvents, events...)
+	kept := retainedUsageEvents(len(all), time.Now(), func(i int) (string, string) { return all[i].CreatedAt, all[i].ServiceInstanceGUID })
+	if kept != nil {
+		l.serviceEvents = make([]cfclient.ServiceUsageEvent, 0, len(kept))
+		for _, i := range kept {
+			l.serviceEvents = append(l.serviceEvents, all[i])
+		}
+	} else {
+		l.serviceEvents = all
+	}
+	return l.serviceEvents, nil
+}
+
+// retainedUsageEvents the indexes, in order, of the events to keep out of
+//  n, or nil to keep them all: every event within the retention and the last
+//  older event of each app or service instance, event giving the created_at
+//  and resource guid of an event
+func retainedUsageEvents(n int, now time.Time, event func(i int) (string, string)) []int {
+	// the events are oldest first, so the ones past the retention lead
+	cutoff := now.Add(-usageEventRetention)
+	old := 0
+	for ; old < n; old++ {
+		createdAt, _ := event(old)
+		if t, err := time.Parse(time.RFC3339, createdAt); err != nil || !t.Before(cutoff) {
+			break
+		}
+	}
+	last := map[string]int{}
+	for i := 0; i < old; i++ {
+		_, guid := event(i)
+		last[guid] = i
+	}
+	if len(last) == old {
+		return nil
+	}
+
+	var kept []int
+	for i := 0; i < n; i++ {
+		if _, guid := event(i); i >= old || last[guid] == i {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
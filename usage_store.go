@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/palantir/stacktrace"
+)
+
+// kinds of usage kept in the store, also the name of their sub directory
+const (
+	appUsageKind     = "app"
+	serviceUsageKind = "service"
+)
+
+// defaults for how far back and how often the collector fills in missing days
+const (
+	defaultUsageStoreDays     = 31
+	defaultUsageStoreInterval = time.Hour
+)
+
+// UsageStore keeps one file of flattened usage rows per kind and day on disk,
+//  so historical ranges are not fetched from the usage service again
+type UsageStore struct {
+	dir string
+}
+
+// usageStore is nil unless USAGE_STORE_DIR is set
+var usageStore *UsageStore
+
+// NewUsageStore creates the store directories under dir
+func NewUsageStore(dir string) (*UsageStore, error) {
+	for _, kind := range []string{appUsageKind, serviceUsageKind} {
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0755); err != nil {
+			return nil, stacktrace.Propagate(err, "Couldn't create usage store directory %s", dir)
+		}
+	}
+	return &UsageStore{dir: dir}, nil
+}
+
+// path of the file holding a single day of usage
+func (s *UsageStore) path(kind string, day time.Time) string {
+	return filepath.Join(s.dir, kind, day.Format(dateFormat)+".json")
+}
+
+// HasDay reports whether the day has already been collected
+func (s *UsageStore) HasDay(kind string, day time.Time) bool {
+	_, err := os.Stat(s.path(kind, day))
+	return err == nil
+}
+
+// Covers reports whether every day from start to end has been collected
+func (s *UsageStore) Covers(kind string, start time.Time, end time.Time) bool {
+	if end.Before(start) {
+		return false
+	}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if !s.HasDay(kind, day) {
+			return false
+		}
+	}
+	return true
+}
+
+// save writes a day of usage, going through a temporary file so a crash
+//  never leaves a half written day that looks collected
+func (s *UsageStore) save(kind string, day time.Time, usage interface{}) error {
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't encode %s usage for %s", kind, day.Format(dateFormat))
+	}
+	target := s.path(kind, day)
+	if err := ioutil.WriteFile(target+".tmp", b, 0644); err != nil {
+		return stacktrace.Propagate(err, "Couldn't write %s", target)
+	}
+	if err := os.Rename(target+".tmp", target); err != nil {
+		return stacktrace.Propagate(err, "Couldn't write %s", target)
+	}
+	return nil
+}
+
+// load reads a day of usage
+func (s *UsageStore) load(kind string, day time.Time, usage interface{}) error {
+	b, err := ioutil.ReadFile(s.path(kind, day))
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't read %s usage for %s", kind, day.Format(dateFormat))
+	}
+	if err := json.Unmarshal(b, usage); err != nil {
+		return stacktrace.Propagate(err, "Couldn't decode %s usage for %s", kind, day.Format(dateFormat))
+	}
+	return nil
+}
+
+// AppUsage merges the stored days into the same rows the usage service
+//  returns for the whole range, summing the duration of each app
+func (s *UsageStore) AppUsage(start time.Time, end time.Time) (*FlattenAppUsage, error) {
+	var report FlattenAppUsage
+	index := map[string]int{}
+
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		var daily FlattenAppUsage
+		if err := s.load(appUsageKind, day, &daily); err != nil {
+			return nil, err
+		}
+		for _, row := range daily.Orgs {
+			key := fmt.Sprintf("%s/%s/%d/%d", row.OrganizationGUID, row.AppGUID, row.InstanceCount, row.MemoryInMbPerInstance)
+			i, found := index[key]
+			if !found {
+				index[key] = len(report.Orgs)
+				report.Orgs = append(report.Orgs, row)
+				continue
+			}
+			merged := &report.Orgs[i]
+			merged.DurationInSeconds += row.DurationInSeconds
+			merged.PeriodEnd = row.PeriodEnd
+			merged.OrgName = row.OrgName
+			merged.SpaceName = row.SpaceName
+			merged.AppName = row.AppName
+		}
+	}
+	return &report, nil
+}
+
+// ServiceUsage merges the stored days into the same rows the usage service
+//  returns for the whole range, summing the duration of each instance
+func (s *UsageStore) ServiceUsage(start time.Time, end time.Time) (*FlattenServiceUsage, error) {
+	var report FlattenServiceUsage
+	index := map[string]int{}
+
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		var daily FlattenServiceUsage
+		if err := s.load(serviceUsageKind, day, &daily); err != nil {
+			return nil, err
+		}
+		for _, row := range daily.Orgs {
+			key := row.OrganizationGUID + "/" + row.ServiceInstanceGUID + "/" + row.ServicePlanGUID
+			i, found := index[key]
+			if !found {
+				index[key] = len(report.Orgs)
+				report.Orgs = append(report.Orgs, row)
+				continue
+			}
+			merged := &report.Orgs[i]
+			merged.DurationInSeconds += row.DurationInSeconds
+			merged.PeriodEnd = row.PeriodEnd
+			merged.Deleted = row.Deleted
+			merged.OrgName = row.OrgName
+			merged.SpaceName = row.SpaceName
+			merged.ServiceInstanceName = row.ServiceInstanceName
+			merged.ServiceInstanceDeletion = row.ServiceInstanceDeletion
+		}
+	}
+	return &report, nil
+}
+
+// Collect fetches every missing day from yesterday back the given number of
+//  days, today is never stored since its usage is still changing; a day
+//  that fails is logged and left for the next run so the days before it
+//  are still collected
+func (s *UsageStore) Collect(ctx context.Context, client *cfclient.Client, days int) error {
+	yesterday := time.Now().Local().AddDate(0, 0, -1)
+	failed := 0
+	for i := 0; i < days; i++ {
+		day := yesterday.AddDate(0, 0, -i)
+
+		if !s.HasDay(appUsageKind, day) {
+			fmt.Println("Collecting app usage for", day.Format(dateFormat))
+			usage, err := GenAppUsageReport(ctx, client, day, day, ReportOptions{})
+			if err == nil {
+				err = s.save(appUsageKind, day, usage)
+			}
+			if err != nil {
+				fmt.Println("error:", stacktrace.Propagate(err, "Couldn't collect app usage for %s", day.Format(dateFormat)))
+				failed++
+			}
+		}
+
+		if !s.HasDay(serviceUsageKind, day) {
+			fmt.Println("Collecting service usage for", day.Format(dateFormat))
+			usage, err := GetServiceUsageReport(ctx, client, day, day, ReportOptions{})
+			if err == nil {
+				err = s.save(serviceUsageKind, day, usage)
+			}
+			if err != nil {
+				fmt.Println("error:", stacktrace.Propagate(err, "Couldn't collect service usage for %s", day.Format(dateFormat)))
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return stacktrace.NewError("Couldn't collect %d of the usage days, they will be tried again on the next run", failed)
+	}
+	return nil
+}
+
+// RunCollector collects missing days now and then again on every interval,
+//  with whichever client is current at the time
+func (s *UsageStore) RunCollector(days int, interval time.Duration) {
+	for {
+		if err := s.Collect(context.Background(), CfClient(), days); err != nil {
+			fmt.Println("error:", err)
+		}
+		time.Sleep(interval)
+	}
+}
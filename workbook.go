@@ -0,0 +1,130 @@
+package main
+
+import (
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// OrgUsageSummary an org's app, service and task usage over the period
+type OrgUsageSummary struct {
+	OrganizationGUID     string  `json:"organization_guid" csv:"organization_guid"`
+	OrgName              string  `json:"organization_name" csv:"organization_name"`
+	Apps                 int     `json:"apps" csv:"apps"`
+	AppInstanceHours     float64 `json:"app_instance_hours" csv:"app_instance_hours"`
+	AppMemoryGBHours     float64 `json:"app_memory_gb_hours" csv:"app_memory_gb_hours"`
+	ServiceInstances     int     `json:"service_instances" csv:"service_instances"`
+	ServiceInstanceHours float64 `json:"service_instance_hours" csv:"service_instance_hours"`
+	Tasks                int     `json:"tasks" csv:"tasks"`
+	TaskHours            float64 `json:"task_hours" csv:"task_hours"`
+	TaskMemoryGBHours    float64 `json:"task_memory_gb_hours" csv:"task_memory_gb_hours"`
+}
+
+// SummarizeOrgUsage totals the app, service and task usage of each org,
+//  across every bucket, in the order the orgs were first seen
+func SummarizeOrgUsage(appUsage *FlattenAppUsage, serviceUsage *FlattenServiceUsage, taskUsage *FlattenTaskUsage) []OrgUsageSummary {
+	var order []string
+	summaries := map[string]*OrgUsageSummary{}
+	summary := func(group UsageGroup) *OrgUsageSummary {
+		s, found := summaries[group.OrganizationGUID]
+		if !found {
+			s = &OrgUsageSummary{OrganizationGUID: group.OrganizationGUID, OrgName: group.OrgName}
+			summaries[group.OrganizationGUID] = s
+			order = append(order, group.OrganizationGUID)
+		}
+		return s
+	}
+
+	orgKeys := []string{orgGroup}
+	for _, group := range GroupAppUsage(appUsage, orgKeys).Groups {
+		s := summary(group)
+		s.Apps += group.Rows
+		s.AppInstanceHours += group.InstanceHours
+		s.AppMemoryGBHours += group.MemoryGBHours
+	}
+	for _, group := range GroupServiceUsage(serviceUsage, orgKeys).Groups {
+		s := summary(group)
+		s.ServiceInstances += group.Rows
+		s.ServiceInstanceHours += group.InstanceHours
+	}
+	for _, group := range GroupTaskUsage(taskUsage, orgKeys).Groups {
+		s := summary(group)
+		s.Tasks += group.Rows
+		s.TaskHours += group.InstanceHours
+		s.TaskMemoryGBHours += group.MemoryGBHours
+	}
+
+	list := make([]OrgUsageSummary, 0, len(order))
+	for _, guid := range order {
+		list = append(list, *summaries[guid])
+	}
+	return list
+}
+
+// appUsageSheets the app usage rows and their totals per org
+func appUsageSheets(usageReport *FlattenAppUsage) []xlsxSheet {
+	return []xlsxSheet{
+		{"App Usage", usageReport.Orgs},
+		{"Org Summary", GroupAppUsage(usageReport, []string{orgGroup}).Groups},
+	}
+}
+
+// serviceUsageSheets the service usage rows and their totals per org
+func serviceUsageSheets(usageReport *FlattenServiceUsage) []xlsxSheet {
+	return []xlsxSheet{
+		{"Service Usage", usageReport.Orgs},
+		{"Org Summary", GroupServiceUsage(usageReport, []string{orgGroup}).Groups},
+	}
+}
+
+// taskUsageSheets the task usage rows and their totals per org
+func taskUsageSheets(usageReport *FlattenTaskUsage) []xlsxSheet {
+	return []xlsxSheet{
+		{"Task Usage", usageReport.Orgs},
+		{"Org Summary", GroupTaskUsage(usageReport, []string{orgGroup}).Groups},
+	}
+}
+
+// aiUsageSheets the daily application instances of the foundation, orgs
+//  and spaces
+func aiUsageSheets(usageReport *AIUsage) []xlsxSheet {
+	return []xlsxSheet{
+		{"AI Usage", usageReport.Days},
+	}
+}
+
+// usageWorkbookReport generates the app, service and task usage reports for
+//  the range as a single workbook with an org summary sheet
+//  /usage-workbook?start=2017-11-01&end=2017-11-30, /usage-workbook/lastmonth
+func usageWorkbookReport(c echo.Context, start time.Time, end time.Time) error {
+	opts, err := GetReportOptions(c)
+	if err != nil {
+		return err
+	}
+
+	// the app and service usage cover the same orgs, list them once
+	if opts.Orgs, err = ListReportOrgs(CfClient(), start, end); err != nil {
+		return stacktrace.Propagate(err, "Couldn't list the orgs for the workbook")
+	}
+	appUsage, err := appUsageForRange(c.Request().Context(), start, end, opts)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't get app usage report for workbook")
+	}
+	serviceUsage, err := serviceUsageForRange(c.Request().Context(), start, end, opts)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't get service usage report for workbook")
+	}
+	taskUsage, err := GetTaskUsageReport(c.Request().Context(), CfClient(), start, end, opts)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't get task usage report for workbook")
+	}
+
+	errs := append(append(append([]OrgUsageError{}, appUsage.Errors...), serviceUsage.Errors...), taskUsage.Errors...)
+	return xlsxFormatter(c, errs,
+		xlsxSheet{"App Usage", appUsage.Orgs},
+		xlsxSheet{"Service Usage", serviceUsage.Orgs},
+		xlsxSheet{"Task Usage", taskUsage.Orgs},
+		xlsxSheet{"Org Summary", SummarizeOrgUsage(appUsage, serviceUsage, taskUsage)},
+	)
+}
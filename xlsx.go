@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/palantir/stacktrace"
+)
+
+// content type of an Excel workbook
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// cell styles of styles.xml
+const (
+	xlsxHeaderStyle   = 1
+	xlsxDateStyle     = 2
+	xlsxDateTimeStyle = 3
+)
+
+// Excel counts days from the end of 1899
+var xlsxEpoch = time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+
+// xlsxSheet a worksheet, rows being a slice of structs whose csv tags name
+//  the columns like csvutil
+type xlsxSheet struct {
+	name string
+	rows interface{}
+}
+
+// xlsxColumn a field of the rows, index being its path through embedded structs
+type xlsxColumn struct {
+	header    string
+	index     []int
+	omitempty bool
+	date      bool
+}
+
+// xlsxFormatter returns the sheets as a workbook, listing failed orgs in
+//  the X-Usage-Errors header like csv
+func xlsxFormatter(c echo.Context, errs []OrgUsageError, sheets ...xlsxSheet) error {
+	fmt.Println("xlsx output requested")
+	setOrgUsageErrorsHeader(c, errs)
+	b, err := MarshalXLSX(sheets...)
+	if err != nil {
+		return stacktrace.Propagate(err, "Couldn't create workbook")
+	}
+	setContentDisposition(c, "xlsx")
+	return c.Blob(http.StatusOK, xlsxContentType, b)
+}
+
+// MarshalXLSX writes the sheets as an Excel workbook with a frozen header
+//  row, numbers and booleans typed as such, times and the YYYY-MM-DD strings
+//  of xlsx:"date" fields as dates, and json omitempty columns dropped when
+//  empty in every row
+func MarshalXLSX(sheets ...xlsxSheet) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	add := func(name string, content string) error {
+		f, err := w.Create(name)
+		if err != nil {
+			return stacktrace.Propagate(err, "Couldn't add %s to workbook", name)
+		}
+		_, err = f.Write([]byte(xml.Header + content))
+		return err
+	}
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	for i, sheet := range sheets {
+		content, err := xlsxWorksheet(sheet.rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Couldn't write sheet %s", sheet.name)
+		}
+		if err := add(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), content); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxEscape(xlsxSheetName(sheet.name)), i+1, i+1)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(sheets)+1)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			contentTypes.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + workbook.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			workbookRels.String() + `</Relationships>`},
+		{"xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+			`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+			`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+			`<cellXfs count="4">` +
+			`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+			`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+			`<xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+			`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+			`</cellXfs></styleSheet>`},
+	}
+	for _, part := range parts {
+		if err := add(part.name, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, stacktrace.Propagate(err, "Couldn't write workbook")
+	}
+	return buf.Bytes(), nil
+}
+
+// xlsxWorksheet writes the rows as a worksheet, the csv tags as its header
+func xlsxWorksheet(rows interface{}) (string, error) {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		return "", stacktrace.NewError("Rows must be a slice of structs, not %s", v.Type())
+	}
+	var columns []xlsxColumn
+	for _, column := range xlsxColumns(v.Type().Elem(), nil) {
+		if column.omitempty && xlsxEmptyColumn(v, column) {
+			continue
+		}
+		columns = append(columns, column)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	sb.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	sb.WriteString(`<sheetData><row r="1">`)
+	for i, column := range columns {
+		fmt.Fprintf(&sb, `<c r="%s1" t="inlineStr" s="%d"><is><t>%s</t></is></c>`, xlsxColumnName(i), xlsxHeaderStyle, xlsxEscape(column.header))
+	}
+	sb.WriteString(`</row>`)
+	for r := 0; r < v.Len(); r++ {
+		fmt.Fprintf(&sb, `<row r="%d">`, r+2)
+		for i, column := range columns {
+			sb.WriteString(xlsxCell(fmt.Sprintf("%s%d", xlsxColumnName(i), r+2), v.Index(r).FieldByIndex(column.index), column.date))
+		}
+		sb.WriteString(`</row>`)
+	}
+	sb.WriteString(`</sheetData></worksheet>`)
+	return sb.String(), nil
+}
+
+// xlsxColumns the exported csv fields of the struct, descending into
+//  embedded structs
+func xlsxColumns(t reflect.Type, parent []int) []xlsxColumn {
+	var columns []xlsxColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			columns = append(columns, xlsxColumns(f.Type, index)...)
+			continue
+		}
+		header := strings.Split(f.Tag.Get("csv"), ",")[0]
+		if f.PkgPath != "" || header == "-" {
+			continue
+		}
+		if header == "" {
+			header = f.Name
+		}
+		switch f.Type.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+			continue
+		}
+		columns = append(columns, xlsxColumn{
+			header:    header,
+			index:     index,
+			omitempty: strings.Contains(f.Tag.Get("json"), ",omitempty"),
+			date:      f.Tag.Get("xlsx") == "date",
+		})
+	}
+	return columns
+}
+
+// xlsxEmptyColumn reports whether the column is empty in every row
+func xlsxEmptyColumn(rows reflect.Value, column xlsxColumn) bool {
+	for r := 0; r < rows.Len(); r++ {
+		field := rows.Index(r).FieldByIndex(column.index)
+		if field.Interface() != reflect.Zero(field.Type()).Interface() {
+			return false
+		}
+	}
+	return true
+}
+
+// xlsxCell writes a single typed cell, zero times left blank and the
+//  YYYY-MM-DD strings of date columns written as dates
+func xlsxCell(ref string, field reflect.Value, date bool) string {
+	switch value := field.Interface().(type) {
+	case time.Time:
+		if value.IsZero() {
+			return ""
+		}
+		return fmt.Sprintf(`<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxDateTimeStyle, xlsxSerial(value))
+	case bool:
+		b := 0
+		if value {
+			b = 1
+		}
+		return fmt.Sprintf(`<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf(`<c r="%s"><v>%d</v></c>`, ref, field.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf(`<c r="%s"><v>%d</v></c>`, ref, field.Uint())
+	case reflect.Float32, reflect.Float64:
+		return fmt.Sprintf(`<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(field.Float(), 'f', -1, 64))
+	case reflect.String:
+		s := field.String()
+		if s == "" {
+			return ""
+		}
+		if day, err := time.Parse(dateFormat, s); date && err == nil {
+			return fmt.Sprintf(`<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxDateStyle, xlsxSerial(day))
+		}
+		return fmt.Sprintf(`<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xlsxEscape(s))
+	}
+	return fmt.Sprintf(`<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, xlsxEscape(fmt.Sprint(field.Interface())))
+}
+
+// xlsxSerial the Excel serial number of the time, keeping its wall clock
+func xlsxSerial(t time.Time) string {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return strconv.FormatFloat(wall.Sub(xlsxEpoch).Hours()/24, 'f', -1, 64)
+}
+
+// xlsxColumnName the letters of the zero based column, A to Z then AA on
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxSheetName a sheet name Excel accepts, at most 31 characters without []:*?/\
+func xlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, name)
+	if len(name) > 31 {
+		name = name[:31]
+	}
+	return name
+}
+
+// xlsxEscape escapes text for the workbook's XML
+func xlsxEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}